@@ -1,9 +1,13 @@
 package admission
 
 import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestAdmissions_Find(t *testing.T) {
@@ -93,4 +97,292 @@ func TestAdmissions_Order(t *testing.T) {
 		println(strings.Join(names, " "))
 		t.Fatalf("failed")
 	}
+
+	// check close removes all admissions and closes their code
+	adm.Close()
+	if len(adm.List()) != 0 || adm.Get("ns", "n1") != nil {
+		t.Fatalf("failed")
+	}
+	select {
+	case <-code.Done():
+	default:
+		t.Fatalf("failed")
+	}
+}
+
+func TestAdmissions_Migrate(t *testing.T) {
+	adm := NewAdmissions()
+
+	// first version, counting created objects
+	code, err := adm.Upsert(&Admission{
+		Name:       "m",
+		Resources:  []string{"pods"},
+		Javascript: `function jsa_init(state) { state.count = 0 } function jsa_created(obj, sync, state) { state.count++ }`,
+		Timeout:    time.Second,
+	})
+	if err != nil || code.Previous != nil {
+		t.Fatalf("failed")
+	}
+	_ = code.Init(false)
+	_ = code.Created(&unstructured.Unstructured{Object: map[string]interface{}{}})
+	_ = code.Created(&unstructured.Unstructured{Object: map[string]interface{}{}})
+	adm.Activate(code)
+
+	// second version, migrating count
+	code2, err := adm.Upsert(&Admission{
+		Name:       "m",
+		Resources:  []string{"pods"},
+		Javascript: `function jsa_init(state) { state.count = 0 } function jsa_migrate(oldState, state) { state.total = oldState.count; oldState.count = -1 }`,
+		Timeout:    time.Second,
+	})
+	if err != nil || code2.Previous != code {
+		t.Fatalf("failed")
+	}
+
+	// check previous code is still serving
+	if codes := adm.Find("pods", ""); len(codes) != 1 || codes[0] != code {
+		t.Fatalf("failed")
+	}
+
+	// check state is migrated and old state is untouched
+	_ = code2.Init(false)
+	if err = code2.Migrate(code2.Previous); err != nil {
+		t.Fatalf("failed")
+	}
+	if code2.Context.GetState()["total"] != int64(2) || code.Context.GetState()["count"] != int64(2) {
+		t.Fatalf("failed")
+	}
+
+	// check new code is serving after activation
+	adm.Activate(code2)
+	if codes := adm.Find("pods", ""); len(codes) != 1 || codes[0] != code2 || code2.Previous != nil {
+		t.Fatalf("failed")
+	}
+}
+
+func TestAdmission_Matches(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"kind": "Pod",
+		"metadata": map[string]interface{}{
+			"name":   "pod-1",
+			"labels": map[string]interface{}{"app": "a"},
+		},
+		"status": map[string]interface{}{"phase": "Running"},
+	}}
+
+	// check admission without selectors matches all objects
+	adm := &Admission{}
+	if !adm.Matches(obj) {
+		t.Fatalf("failed")
+	}
+
+	// check label and field selectors
+	adm.LabelSelector, _ = labels.Parse("app in (a,b)")
+	adm.FieldSelector, _ = fields.ParseSelector("metadata.name=pod-1,status.phase!=Pending")
+	if !adm.Matches(obj) {
+		t.Fatalf("failed")
+	}
+	adm.FieldSelector, _ = fields.ParseSelector("status.phase=Pending")
+	if adm.Matches(obj) {
+		t.Fatalf("failed")
+	}
+	adm.FieldSelector = nil
+	adm.LabelSelector, _ = labels.Parse("app=b")
+	if adm.Matches(obj) {
+		t.Fatalf("failed")
+	}
+}
+
+func TestAdmission_Lookup(t *testing.T) {
+	pod := &unstructured.Unstructured{}
+	pod.SetNamespace("ns1")
+	pod.SetName("pod-1")
+	lookups := make([]string, 0)
+	adm := &Admission{
+		Namespace: "ns1",
+		Name:      "adm",
+		Javascript: `
+function jsa_created(obj, sync, state) {
+  var pods = jsa_lookup("pods", "node", "node1", "ns2");
+  pods[0].metadata.name = "changed";
+  state.name = pods[0].metadata.name;
+  state.count = jsa_lookup("pods", "label", "app=x").length;
+}
+function node_index(obj) { return [obj.metadata.name, 1] }
+`,
+		Timeout: time.Second,
+		Indexes: []Index{{Name: "node", Path: "spec.nodeName"}, {Name: "custom", Function: "node_index"}},
+		Lookup: func(kind string, namespace string, index string, value string) ([]*unstructured.Unstructured, error) {
+			lookups = append(lookups, strings.Join([]string{kind, namespace, index, value}, ","))
+			return []*unstructured.Unstructured{pod.DeepCopy()}, nil
+		},
+	}
+	code, err := newAdmissionCode(adm)
+	if err != nil {
+		t.Fatalf("failed")
+	}
+	defer code.Close()
+
+	// check lookups are restricted to admission namespace, and declared indexes are resolved
+	if err = code.Created(pod); err != nil {
+		t.Fatalf("failed")
+	}
+	if len(lookups) != 2 || lookups[0] != "pods,ns1,ns1/adm/node,node1" || lookups[1] != "pods,ns1,label,app=x" {
+		t.Fatalf("failed")
+	}
+	if code.Context.GetState()["count"] != int64(1) || code.Context.GetState()["name"] != "changed" || pod.GetName() != "pod-1" {
+		t.Fatalf("failed")
+	}
+
+	// check javascript index function
+	values := code.Indexer(adm.Indexes[1])(pod)
+	if len(values) != 2 || values[0] != "pod-1" || values[1] != "1" {
+		t.Fatalf("failed")
+	}
+}
+
+func TestAdmission_Resync(t *testing.T) {
+	adm := &Admission{
+		Name: "adm",
+		Javascript: `
+function jsa_resync(objs, state, sync) { state.count = objs.length; state.name = objs[0].metadata.name }
+`,
+		Timeout: time.Second,
+	}
+	code, err := newAdmissionCode(adm)
+	if err != nil {
+		t.Fatalf("failed")
+	}
+	pod := &unstructured.Unstructured{}
+	pod.SetName("pod-1")
+
+	// check jsa_resync receives all objects, and can update state
+	if err = code.Resync([]*unstructured.Unstructured{pod, pod}); err != nil {
+		t.Fatalf("failed")
+	}
+	if code.Context.GetState()["count"] != int64(2) || code.Context.GetState()["name"] != "pod-1" {
+		t.Fatalf("failed")
+	}
+
+	// check done is closed once, even if closed twice
+	code.Close()
+	code.Close()
+	select {
+	case <-code.Done():
+	default:
+		t.Fatalf("failed")
+	}
+}
+
+func TestAdmission_Generate(t *testing.T) {
+	adm := &Admission{
+		Name: "adm",
+		Javascript: `
+function jsa_generate(obj, op) {
+  if (op == "UPDATE") return;
+  if (op == "DELETE") return "invalid";
+  return [{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "cm-" + obj.metadata.name } }]
+}
+`,
+		Timeout: time.Second,
+	}
+	code, err := newAdmissionCode(adm)
+	if err != nil {
+		t.Fatalf("failed")
+	}
+	ns := &unstructured.Unstructured{}
+	ns.SetName("ns")
+
+	// check generated objects are returned
+	objs, err := code.Generate("CREATE", ns)
+	if err != nil || len(objs) != 1 || objs[0].GetName() != "cm-ns" || objs[0].GetKind() != "ConfigMap" {
+		t.Fatalf("failed")
+	}
+
+	// check nothing is generated, or an error if not a list
+	objs, err = code.Generate("UPDATE", ns)
+	if err != nil || len(objs) != 0 {
+		t.Fatalf("failed")
+	}
+	if _, err = code.Generate("DELETE", ns); err == nil {
+		t.Fatalf("failed")
+	}
+}
+
+func TestAdmission_Cleanup(t *testing.T) {
+	adm := &Admission{
+		Name: "adm",
+		Javascript: `
+function jsa_cleanup(obj, now) {
+  return now - Date.parse(obj.metadata.creationTimestamp) > 3 * 86400 * 1000
+}
+`,
+		Timeout: time.Second,
+	}
+	code, err := newAdmissionCode(adm)
+	if err != nil {
+		t.Fatalf("failed")
+	}
+	job := &unstructured.Unstructured{}
+	job.SetCreationTimestamp(metav1.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	// check objects are only deleted when older than 3 days
+	res, err := code.Cleanup(job, time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC))
+	if err != nil || res {
+		t.Fatalf("failed")
+	}
+	res, err = code.Cleanup(job, time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC))
+	if err != nil || !res {
+		t.Fatalf("failed")
+	}
+
+	// check batches select the same objects
+	err = code.Batch(func(b *AdmissionBatch) error {
+		res, err = b.Cleanup(job, time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC))
+		return err
+	})
+	if err != nil || !res {
+		t.Fatalf("failed")
+	}
+}
+
+func TestAdmission_Scheduled(t *testing.T) {
+	adm := &Admission{
+		Name: "adm",
+		Javascript: `
+function jsa_cron(state, now) {
+  state.runs = (state.runs || 0) + 1
+  state.last = now
+}
+function hourly(state) {
+  state.hourly = true
+}
+`,
+		Timeout: time.Second,
+	}
+	code, err := newAdmissionCode(adm)
+	if err != nil {
+		t.Fatalf("failed")
+	}
+
+	// check scheduled functions update state
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err = code.Scheduled(JsaCron, now); err != nil {
+		t.Fatalf("failed")
+	}
+	if err = code.Scheduled(JsaCron, now); err != nil {
+		t.Fatalf("failed")
+	}
+	if err = code.Scheduled("hourly", now); err != nil {
+		t.Fatalf("failed")
+	}
+	state := code.Context.GetState()
+	if state["runs"] != int64(2) || state["last"] != now.UnixMilli() || state["hourly"] != true {
+		t.Fatalf("failed: %v", state)
+	}
+
+	// check missing functions fail
+	if err = code.Scheduled("missing", now); err == nil {
+		t.Fatalf("failed")
+	}
 }
@@ -3,10 +3,19 @@ package admission
 import (
 	"fmt"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/dop251/goja"
+	"github.com/momiji/js-admissions-controller/events"
+	"github.com/momiji/js-admissions-controller/logs"
+	"github.com/momiji/js-admissions-controller/store"
 	admission "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 type Admissions struct {
@@ -20,16 +29,60 @@ type Admission struct {
 	Name       string
 	Resources  []string
 	Javascript string
-	Timeout    int
+	Persist    bool
+	Owner      metav1.OwnerReference
+	// WatchOwner is the owner of the resources watched for this code, released when the code is replaced or removed
+	WatchOwner string
+	// Timeout is the max duration of javascript calls, and Limits the limits of javascript execution
+	Timeout time.Duration
+	Limits  Limits
+	// State is the state backend, or nil to keep state in memory
+	State StateBackend
+	// LeaderOnly is true if events must only be handled by the leader
+	LeaderOnly bool
+	// Workers is the number of workers delivering events, and Retries the number of retries of failed events
+	Workers int
+	Retries int
+	// LabelSelector and FieldSelector filter objects received by events, or nil to receive all objects
+	LabelSelector labels.Selector
+	FieldSelector fields.Selector
+	// Indexes are the indexes declared by the admission on its resources
+	Indexes []Index
+	// Lookup returns cached objects for jsa_lookup, or nil to disable it
+	Lookup LookupFunc
+	// Resync is the interval between calls to jsa_resync, or 0 to disable it
+	Resync time.Duration
+	// Background is the interval between background scans of cached objects, or 0 to disable them
+	Background time.Duration
+	// GenerateSync is true if generated objects are also applied on updates, and GenerateDelete if they are deleted with their trigger object
+	GenerateSync   bool
+	GenerateDelete bool
 }
 
+// Index is an index declared by an admission, using either a JSON pointer path like /spec/nodeName or a javascript function.
+type Index struct {
+	Name     string
+	Path     string
+	Function string
+}
+
+// LookupFunc returns copies of cached objects of a kind, in namespace or all namespaces if namespace="", having this value in the index.
+//
+// If index is empty, all objects are returned.
+type LookupFunc func(kind string, namespace string, index string, value string) ([]*unstructured.Unstructured, error)
+
 type AdmissionList struct {
 	admissions map[string]*AdmissionCode
 }
 type AdmissionCode struct {
 	Admission *Admission
 	Context   *JsContext
+	Events    *events.Queue
 	IsValid   bool
+	// Previous is the code still serving requests until this one is activated, only set when state can be migrated
+	Previous *AdmissionCode
+	done     chan struct{}
+	closed   sync.Once
 }
 
 func NewAdmissions() *Admissions {
@@ -47,17 +100,40 @@ func newAdmissionList() *AdmissionList {
 }
 
 func newAdmissionCode(adm *Admission) (*AdmissionCode, error) {
-	js, err := NewJsContext(adm.FullName(), adm.Javascript, adm.Timeout)
+	state := adm.State
+	if state == nil {
+		state = NewMemoryBackend()
+	}
+	var lookup LookupFunc
+	if adm.Lookup != nil {
+		lookup = adm.lookup
+	}
+	js, err := NewJsContext(adm.FullName(), adm.Javascript, adm.Timeout, adm.Limits, state, lookup)
 	if err != nil {
 		return nil, err
 	}
 	return &AdmissionCode{
 		Admission: adm,
 		Context:   js,
+		Events:    events.NewQueue(adm.FullName(), adm.Workers, adm.Retries),
 		IsValid:   false,
+		done:      make(chan struct{}),
 	}, nil
 }
 
+// Close stops delivering events, dropping pending ones.
+func (c *AdmissionCode) Close() {
+	c.Events.ShutDown()
+	c.closed.Do(func() {
+		close(c.done)
+	})
+}
+
+// Done returns a channel closed when the code is closed, to stop background tasks like resync.
+func (c *AdmissionCode) Done() <-chan struct{} {
+	return c.done
+}
+
 func (a *Admission) FullName() string {
 	if a.Namespace == "" {
 		return a.Name
@@ -65,6 +141,69 @@ func (a *Admission) FullName() string {
 	return fmt.Sprintf("%s.%s", a.Namespace, a.Name)
 }
 
+// IndexName returns the name of an index in cache, unique to the admission.
+func (a *Admission) IndexName(name string) string {
+	return fmt.Sprintf("%s/%s/%s", a.Namespace, a.Name, name)
+}
+
+// lookup restricts lookups of a namespace admission to its namespace, and resolves names of indexes declared by the admission.
+func (a *Admission) lookup(kind string, namespace string, index string, value string) ([]*unstructured.Unstructured, error) {
+	if a.Namespace != "" {
+		namespace = a.Namespace
+	}
+	for _, i := range a.Indexes {
+		if i.Name == index {
+			index = a.IndexName(index)
+			break
+		}
+	}
+	return a.Lookup(kind, namespace, index, value)
+}
+
+// Indexer returns the function computing values of an index declared by the admission.
+func (c *AdmissionCode) Indexer(index Index) store.IndexFunc {
+	if index.Function == "" {
+		return store.IndexByPath(index.Path)
+	}
+	return func(obj *unstructured.Unstructured) []string {
+		res, err := c.Context.CallFunction(index.Function, obj.Object)
+		if err != nil {
+			logs.Errorf("Admissions: index %s of %s failed for ns=%s name=%s: %v", index.Name, c.Admission.FullName(), obj.GetNamespace(), obj.GetName(), err)
+			return nil
+		}
+		return store.IndexValues(res)
+	}
+}
+
+// Matches returns true if the object matches the label and field selectors of the admission.
+func (a *Admission) Matches(obj *unstructured.Unstructured) bool {
+	if a.LabelSelector != nil && !a.LabelSelector.Matches(labels.Set(obj.GetLabels())) {
+		return false
+	}
+	if a.FieldSelector != nil && !a.FieldSelector.Matches(objectFields{obj}) {
+		return false
+	}
+	return true
+}
+
+// objectFields gets fields of an object for field selectors, like metadata.name or status.phase.
+type objectFields struct {
+	obj *unstructured.Unstructured
+}
+
+func (f objectFields) Has(field string) bool {
+	_, found, _ := unstructured.NestedFieldNoCopy(f.obj.Object, strings.Split(field, ".")...)
+	return found
+}
+
+func (f objectFields) Get(field string) string {
+	value, found, _ := unstructured.NestedFieldNoCopy(f.obj.Object, strings.Split(field, ".")...)
+	if !found || value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
 func (a *Admissions) Upsert(adm *Admission) (*AdmissionCode, error) {
 	a.mux.Lock()
 	defer a.mux.Unlock()
@@ -78,17 +217,54 @@ func (a *Admissions) Upsert(adm *Admission) (*AdmissionCode, error) {
 	}
 
 	// create code
-	delete(list.admissions, adm.Name)
+	old := list.admissions[adm.Name]
 	code, err := newAdmissionCode(adm)
 	if err != nil {
+		if old != nil {
+			old.Close()
+		}
+		delete(list.admissions, adm.Name)
 		return nil, err
 	}
 
+	// keep old code serving until new code is activated, if its state can be migrated
+	if old != nil && old.IsValid && code.Context.HasFunction(JsaMigrate) {
+		code.Previous = old
+		return code, nil
+	}
+
 	// add code
+	if old != nil {
+		old.Close()
+	}
 	list.admissions[adm.Name] = code
 	return code, nil
 }
 
+// Activate makes the code valid, replacing the previous code if it was still serving.
+func (a *Admissions) Activate(code *AdmissionCode) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	// get list
+	list, ok := a.namespaces[code.Admission.Namespace]
+	if !ok {
+		return
+	}
+
+	// replace previous code, unless admission has been removed or replaced in between
+	if code.Previous != nil {
+		if list.admissions[code.Admission.Name] != code.Previous {
+			code.Close()
+			return
+		}
+		list.admissions[code.Admission.Name] = code
+		code.Previous.Close()
+		code.Previous = nil
+	}
+	code.IsValid = true
+}
+
 func (a *Admissions) Remove(namespace string, name string) {
 	a.mux.Lock()
 	defer a.mux.Unlock()
@@ -100,7 +276,51 @@ func (a *Admissions) Remove(namespace string, name string) {
 	}
 
 	// delete code
-	delete(list.admissions, name)
+	if code, ok := list.admissions[name]; ok {
+		code.Close()
+		delete(list.admissions, name)
+	}
+}
+
+// Close closes and removes all admissions, valid or not.
+func (a *Admissions) Close() {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	for namespace, list := range a.namespaces {
+		for _, code := range list.admissions {
+			code.Close()
+		}
+		delete(a.namespaces, namespace)
+	}
+}
+
+// Get returns the admission code, valid or not, or nil if it does not exist.
+func (a *Admissions) Get(namespace string, name string) *AdmissionCode {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+
+	list, ok := a.namespaces[namespace]
+	if !ok {
+		return nil
+	}
+	return list.admissions[name]
+}
+
+// List returns all valid admissions.
+func (a *Admissions) List() []*AdmissionCode {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+
+	codes := make([]*AdmissionCode, 0)
+	for _, list := range a.namespaces {
+		for _, code := range list.admissions {
+			if code.IsValid {
+				codes = append(codes, code)
+			}
+		}
+	}
+	return codes
 }
 
 // Find returns admissions for current namespace and cluster if namespace != "".
@@ -152,9 +372,20 @@ func (a *Admissions) Find(resource string, namespace string) []*AdmissionCode {
 	return codes
 }
 
-func (c *AdmissionCode) Init() error {
+// Init calls jsa_init, with restored=true if the state has been restored from a previous snapshot.
+func (c *AdmissionCode) Init(restored bool) error {
+	ctx := c.Context
+	_, err := ctx.Call(JsaInit, true, map[string]interface{}{"restored": restored})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Migrate calls jsa_migrate with the state of the previous code, which is left untouched.
+func (c *AdmissionCode) Migrate(old *AdmissionCode) error {
 	ctx := c.Context
-	_, err := ctx.Call(JsaInit, true, map[string]interface{}{"state": &ctx.State})
+	_, err := ctx.Call(JsaMigrate, true, map[string]interface{}{"oldState": old.Context.GetState()})
 	if err != nil {
 		return err
 	}
@@ -163,7 +394,7 @@ func (c *AdmissionCode) Init() error {
 
 func (c *AdmissionCode) Created(obj *unstructured.Unstructured) error {
 	ctx := c.Context
-	_, err := ctx.Call(JsaCreated, false, map[string]interface{}{"state": &ctx.State, "sync": true, "obj": obj.Object})
+	_, err := ctx.Call(JsaCreated, false, map[string]interface{}{"sync": true, "obj": obj.Object})
 	if err != nil {
 		return err
 	}
@@ -172,25 +403,90 @@ func (c *AdmissionCode) Created(obj *unstructured.Unstructured) error {
 
 func (c *AdmissionCode) Updated(obj *unstructured.Unstructured, old *unstructured.Unstructured) error {
 	ctx := c.Context
-	_, err := ctx.Call(JsaUpdated, false, map[string]interface{}{"state": &ctx.State, "sync": true, "obj": obj.Object, "old": old.Object})
+	_, err := ctx.Call(JsaUpdated, false, map[string]interface{}{"sync": true, "obj": obj.Object, "old": old.Object})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Deleted calls jsa_deleted, with inferred=true if the delete has not been observed but found on relist.
+func (c *AdmissionCode) Deleted(obj *unstructured.Unstructured, inferred bool) error {
+	ctx := c.Context
+	_, err := ctx.Call(JsaDeleted, false, map[string]interface{}{"sync": true, "obj": obj.Object, "inferred": inferred})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *AdmissionCode) Deleted(obj *unstructured.Unstructured) error {
+// Resync calls jsa_resync with all cached objects of the admission kinds.
+func (c *AdmissionCode) Resync(objs []*unstructured.Unstructured) error {
 	ctx := c.Context
-	_, err := ctx.Call(JsaDeleted, false, map[string]interface{}{"state": &ctx.State, "sync": true, "obj": obj.Object})
+	list := make([]interface{}, len(objs))
+	for i, obj := range objs {
+		list[i] = obj.Object
+	}
+	_, err := ctx.Call(JsaResync, false, map[string]interface{}{"sync": true, "objs": list})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *AdmissionCode) Validate(operation admission.Operation, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+// Generate calls jsa_generate, returning the objects generated for the trigger object.
+func (c *AdmissionCode) Generate(operation admission.Operation, obj *unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
 	ctx := c.Context
-	res, err := ctx.Call(JsaValidate, false, map[string]interface{}{"state": &ctx.State, "sync": true, "obj": obj.Object, "op": operation})
+	res, err := ctx.Call(JsaGenerate, false, map[string]interface{}{"sync": true, "obj": obj.Object, "op": operation})
+	if err != nil {
+		return nil, err
+	}
+	if res == nil || goja.IsUndefined(res) || goja.IsNull(res) {
+		return nil, nil
+	}
+	list, ok := res.Export().([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must return a list of objects", JsaGenerate)
+	}
+	objs := make([]*unstructured.Unstructured, 0)
+	for _, item := range list {
+		m := ToMap(item)
+		if m == nil {
+			return nil, fmt.Errorf("%s must return a list of objects, got %v", JsaGenerate, item)
+		}
+		objs = append(objs, &unstructured.Unstructured{Object: m})
+	}
+	return objs, nil
+}
+
+// Cleanup calls jsa_cleanup, returning true if the object must be deleted.
+//
+// The current time is passed as milliseconds since epoch, like Date.now().
+func (c *AdmissionCode) Cleanup(obj *unstructured.Unstructured, now time.Time) (bool, error) {
+	ctx := c.Context
+	res, err := ctx.Call(JsaCleanup, false, map[string]interface{}{"sync": true, "obj": obj.Object, "now": now.UnixMilli()})
+	if err != nil || res == nil {
+		return false, err
+	}
+	return res.ToBoolean(), nil
+}
+
+// Scheduled calls a function of spec.schedules, like jsa_cron, with read-write state.
+//
+// The scheduled time is passed as milliseconds since epoch, like Date.now().
+func (c *AdmissionCode) Scheduled(function string, now time.Time) error {
+	ctx := c.Context
+	_, err := ctx.CallScheduled(function, map[string]interface{}{"sync": true, "now": now.UnixMilli()})
+	return err
+}
+
+// OperationBackground is the operation passed to jsa_validate by background scans of existing objects.
+const OperationBackground admission.Operation = "BACKGROUND"
+
+// Validate calls jsa_validate, interrupting it at deadline if it is not the zero time.
+func (c *AdmissionCode) Validate(operation admission.Operation, obj *unstructured.Unstructured, deadline time.Time) (*unstructured.Unstructured, error) {
+	ctx := c.Context
+	res, err := ctx.CallBefore(JsaValidate, false, map[string]interface{}{"sync": true, "obj": obj.Object, "op": operation}, deadline)
 	if err != nil {
 		return nil, err
 	}
@@ -200,9 +496,10 @@ func (c *AdmissionCode) Validate(operation admission.Operation, obj *unstructure
 	return ToUnstructured(res.Export()), nil
 }
 
-func (c *AdmissionCode) Mutate(operation admission.Operation, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+// Mutate calls jsa_mutate, interrupting it at deadline if it is not the zero time.
+func (c *AdmissionCode) Mutate(operation admission.Operation, obj *unstructured.Unstructured, deadline time.Time) (*unstructured.Unstructured, error) {
 	ctx := c.Context
-	res, err := ctx.Call(JsaMutate, false, map[string]interface{}{"state": &ctx.State, "sync": true, "obj": obj.Object, "op": operation})
+	res, err := ctx.CallBefore(JsaMutate, false, map[string]interface{}{"sync": true, "obj": obj.Object, "op": operation}, deadline)
 	if err != nil {
 		return nil, err
 	}
@@ -211,3 +508,50 @@ func (c *AdmissionCode) Mutate(operation admission.Operation, obj *unstructured.
 	}
 	return ToUnstructured(res.Export()), nil
 }
+
+// AdmissionBatch calls functions of an admission sharing one state, like for a pass over all cached objects.
+type AdmissionBatch struct {
+	batch *JsBatch
+}
+
+// Batch calls fn with a batch of calls sharing one state, read and written once, see JsContext.Batch.
+//
+// fn may be called several times, so it must not have side effects other than calls.
+func (c *AdmissionCode) Batch(fn func(b *AdmissionBatch) error) error {
+	return c.Context.Batch(func(batch *JsBatch) error {
+		return fn(&AdmissionBatch{batch: batch})
+	})
+}
+
+// Validate calls jsa_validate, like AdmissionCode.Validate.
+func (b *AdmissionBatch) Validate(operation admission.Operation, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	res, err := b.batch.Call(JsaValidate, map[string]interface{}{"sync": true, "obj": obj.Object, "op": operation})
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, nil
+	}
+	return ToUnstructured(res.Export()), nil
+}
+
+// Mutate calls jsa_mutate, like AdmissionCode.Mutate.
+func (b *AdmissionBatch) Mutate(operation admission.Operation, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	res, err := b.batch.Call(JsaMutate, map[string]interface{}{"sync": true, "obj": obj.Object, "op": operation})
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, nil
+	}
+	return ToUnstructured(res.Export()), nil
+}
+
+// Cleanup calls jsa_cleanup, like AdmissionCode.Cleanup.
+func (b *AdmissionBatch) Cleanup(obj *unstructured.Unstructured, now time.Time) (bool, error) {
+	res, err := b.batch.Call(JsaCleanup, map[string]interface{}{"sync": true, "obj": obj.Object, "now": now.UnixMilli()})
+	if err != nil || res == nil {
+		return false, err
+	}
+	return res.ToBoolean(), nil
+}
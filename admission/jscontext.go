@@ -2,6 +2,7 @@ package admission
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/momiji/js-admissions-controller/logs"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -22,19 +23,43 @@ const (
 	JsaCreated  = "jsa_created"
 	JsaUpdated  = "jsa_updated"
 	JsaDeleted  = "jsa_deleted"
+	JsaMigrate  = "jsa_migrate"
+	JsaResync   = "jsa_resync"
+	JsaGenerate = "jsa_generate"
+	JsaCleanup  = "jsa_cleanup"
+	JsaCron     = "jsa_cron"
 )
 
+// DefaultTimeout is the execution timeout of javascript code used when no timeout is set.
+const DefaultTimeout = 10 * time.Second
+
 var (
 	undefined = goja.Undefined()
 )
 
+// functionParameters are the parameters of managed functions, which can be declared in any order.
+var functionParameters = map[string][]string{
+	JsaInit:     {"state", "restored"},
+	JsaMutate:   {"state", "sync", "obj", "op"},
+	JsaValidate: {"state", "sync", "obj", "op"},
+	JsaCreated:  {"state", "sync", "obj"},
+	JsaUpdated:  {"state", "sync", "obj", "old"},
+	JsaDeleted:  {"state", "sync", "obj", "inferred"},
+	JsaMigrate:  {"oldState", "state"},
+	JsaResync:   {"state", "sync", "objs"},
+	JsaGenerate: {"state", "sync", "obj", "op"},
+	JsaCleanup:  {"state", "sync", "obj", "now"},
+	JsaCron:     {"state", "sync", "now"},
+}
+
 type JsContext struct {
 	mux      *sync.RWMutex
 	program  *ast.Program
 	compiled *goja.Program
-	State    map[string]interface{}
+	state    StateBackend
 	pool     *pool.ObjectPool
-	timeout  int
+	timeout  time.Duration
+	limits   Limits
 }
 
 type JsRuntime struct {
@@ -47,7 +72,12 @@ type JsFunction struct {
 	Params map[string]int
 }
 
-func NewJsContext(name string, js string, timeout int) (*JsContext, error) {
+// NewJsContext compiles javascript code, whose calls are interrupted after timeout, or DefaultTimeout if timeout is not set.
+func NewJsContext(name string, js string, timeout time.Duration, limits Limits, state StateBackend, lookup LookupFunc) (*JsContext, error) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
 	// compile code
 	program, err := goja.Parse("", js, parser.WithDisableSourceMaps)
 	if err != nil {
@@ -63,6 +93,9 @@ func NewJsContext(name string, js string, timeout int) (*JsContext, error) {
 	factory := pool.NewPooledObjectFactorySimple(func(ctx context.Context) (interface{}, error) {
 		// create runtime
 		runtime := goja.New()
+		if err := limits.apply(runtime); err != nil {
+			return nil, err
+		}
 		_, err := runtime.RunProgram(compiled)
 		if err != nil {
 			return nil, err
@@ -94,18 +127,40 @@ func NewJsContext(name string, js string, timeout int) (*JsContext, error) {
 			return nil, err
 		}
 
+		// add lookup of cached objects
+		if lookup != nil {
+			err = runtime.Set("jsa_lookup", func(call goja.FunctionCall) goja.Value {
+				arg := func(i int) string {
+					v := call.Argument(i)
+					if goja.IsUndefined(v) || goja.IsNull(v) {
+						return ""
+					}
+					return v.String()
+				}
+				objs, err := lookup(arg(0), arg(3), arg(1), arg(2))
+				if err != nil {
+					panic(runtime.NewGoError(err))
+				}
+				res := make([]interface{}, len(objs))
+				for i, obj := range objs {
+					res[i] = obj.Object
+				}
+				return ToGojaObject(runtime, res)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		// return
 		// TODO potential optimization? compute params in JsContext, so only Get(function_name) remains
+		methods := make(map[string]*JsFunction)
+		for method, parameters := range functionParameters {
+			methods[method] = analyseFunction(runtime, program, method, parameters...)
+		}
 		return &JsRuntime{
 			Runtime: runtime,
-			Methods: map[string]*JsFunction{
-				JsaInit:     analyseFunction(runtime, program, JsaInit, "state"),
-				JsaMutate:   analyseFunction(runtime, program, JsaMutate, "state", "sync", "obj", "op"),
-				JsaValidate: analyseFunction(runtime, program, JsaValidate, "state", "sync", "obj", "op"),
-				JsaCreated:  analyseFunction(runtime, program, JsaCreated, "state", "sync", "obj"),
-				JsaUpdated:  analyseFunction(runtime, program, JsaUpdated, "state", "sync", "obj", "old"),
-				JsaDeleted:  analyseFunction(runtime, program, JsaDeleted, "state", "sync", "obj"),
-			},
+			Methods: methods,
 		}, nil
 	})
 
@@ -117,9 +172,10 @@ func NewJsContext(name string, js string, timeout int) (*JsContext, error) {
 		mux:      &sync.RWMutex{},
 		program:  program,
 		compiled: compiled,
-		State:    make(map[string]interface{}),
+		state:    state,
 		pool:     p,
 		timeout:  timeout,
+		limits:   limits,
 	}
 
 	// return
@@ -155,7 +211,38 @@ func analyseFunction(runtime *goja.Runtime, prg *ast.Program, name string, param
 	return nil
 }
 
+// HasFunction returns true if the javascript code declares a top-level function with this name.
+func (c *JsContext) HasFunction(name string) bool {
+	for _, stmt := range c.program.Body {
+		if decl, ok := stmt.(*ast.FunctionDeclaration); ok {
+			if decl.Function.Name.Name.String() == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetState returns the current state, which must be considered read-only.
+func (c *JsContext) GetState() map[string]interface{} {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.state.Get()
+}
+
+// SetState replaces the current state, like when restoring it from a snapshot.
+func (c *JsContext) SetState(state map[string]interface{}) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.state.Set(state)
+}
+
 func (c *JsContext) Call(method string, forceSync bool, values map[string]interface{}) (goja.Value, error) {
+	return c.CallBefore(method, forceSync, values, time.Time{})
+}
+
+// CallBefore calls a managed function like Call, interrupting it at deadline if it is sooner than the timeout.
+func (c *JsContext) CallBefore(method string, forceSync bool, values map[string]interface{}, deadline time.Time) (goja.Value, error) {
 	background := context.Background()
 	object, err := c.pool.BorrowObject(background)
 	if err != nil {
@@ -165,36 +252,131 @@ func (c *JsContext) Call(method string, forceSync bool, values map[string]interf
 		_ = pool.ReturnObject(ctx, object)
 	}(c.pool, background, object)
 	runtime := object.(*JsRuntime)
-	return c.call(runtime.Runtime, runtime.Methods[method], forceSync, values)
+	return c.call(runtime.Runtime, runtime.Methods[method], forceSync, values, deadline)
 }
 
-func (c *JsContext) call(runtime *goja.Runtime, fn *JsFunction, forceSync bool, values map[string]interface{}) (goja.Value, error) {
+// CallScheduled calls a javascript function by name with the parameters of jsa_cron, locking state like sync.
+func (c *JsContext) CallScheduled(name string, values map[string]interface{}) (goja.Value, error) {
+	background := context.Background()
+	object, err := c.pool.BorrowObject(background)
+	if err != nil {
+		return nil, err
+	}
+	defer func(pool *pool.ObjectPool, ctx context.Context, object interface{}) {
+		_ = pool.ReturnObject(ctx, object)
+	}(c.pool, background, object)
+	runtime := object.(*JsRuntime).Runtime
+
+	fn := analyseFunction(runtime, c.program, name, functionParameters[JsaCron]...)
 	if fn == nil {
-		return nil, nil
+		return nil, fmt.Errorf("function %s not found", name)
 	}
+	return c.call(runtime, fn, true, values, time.Time{})
+}
 
-	// build args
-	var stateSource *map[string]interface{}
-	var stateObject goja.Value
-	withState := false
+// CallFunction calls a javascript function by name without state, like an index function, and returns its exported result.
+func (c *JsContext) CallFunction(name string, values ...interface{}) (interface{}, error) {
+	background := context.Background()
+	object, err := c.pool.BorrowObject(background)
+	if err != nil {
+		return nil, err
+	}
+	defer func(pool *pool.ObjectPool, ctx context.Context, object interface{}) {
+		_ = pool.ReturnObject(ctx, object)
+	}(c.pool, background, object)
+	runtime := object.(*JsRuntime).Runtime
+
+	fn, ok := goja.AssertFunction(runtime.Get(name))
+	if !ok {
+		return nil, fmt.Errorf("function %s not found", name)
+	}
+	args := make([]goja.Value, len(values))
+	for i, v := range values {
+		args[i] = ToGojaObject(runtime, v)
+	}
+	stop := c.interruptAfter(runtime, time.Time{})
+	defer stop()
+	res, err := fn(goja.Undefined(), args...)
+	if err != nil {
+		return nil, err
+	}
+	return res.Export(), nil
+}
+
+// interruptAfter interrupts the runtime after the timeout, or at deadline if it is sooner, returning a function to cancel it.
+//
+// As runtimes are pooled, the returned function guarantees the runtime is not interrupted afterwards,
+// even if the timer fires concurrently, so the next call on the runtime is not interrupted.
+func (c *JsContext) interruptAfter(runtime *goja.Runtime, deadline time.Time) func() {
+	timeout, reason := c.timeout, "timeout"
+	if !deadline.IsZero() && time.Until(deadline) < timeout {
+		timeout, reason = time.Until(deadline), "deadline exceeded"
+	}
+	if timeout <= 0 {
+		// deadline already exceeded
+		runtime.Interrupt(reason)
+		return runtime.ClearInterrupt
+	}
+	mux := sync.Mutex{}
+	stopped := false
+	timer := time.AfterFunc(timeout, func() {
+		mux.Lock()
+		defer mux.Unlock()
+		if !stopped {
+			runtime.Interrupt(reason)
+		}
+	})
+	return func() {
+		mux.Lock()
+		stopped = true
+		mux.Unlock()
+		timer.Stop()
+		runtime.ClearInterrupt()
+	}
+}
+
+// args returns the arguments of a managed function, where args[0] receives values of unknown parameters.
+func (c *JsContext) args(runtime *goja.Runtime, fn *JsFunction, values map[string]interface{}) []goja.Value {
 	args := []goja.Value{undefined, undefined, undefined, undefined, undefined}
 	for n, v := range values {
-		if n == "state" {
-			withState = true
-			// special case with state, we keep ptr to the map
-			// and keep object for later export
-			stateSource = v.(*map[string]interface{})
-			stateObject = ToGojaObject(runtime, *stateSource)
-			args[fn.Params[n]] = stateObject
-		} else {
-			args[fn.Params[n]] = ToGojaObject(runtime, v)
-		}
+		args[fn.Params[n]] = ToGojaObject(runtime, v)
 	}
 	args[0] = undefined
+	return args
+}
+
+// run calls a managed function with its arguments, checking the limits of its result.
+func (c *JsContext) run(runtime *goja.Runtime, fn *JsFunction, args []goja.Value, deadline time.Time) (goja.Value, error) {
+	stop := c.interruptAfter(runtime, deadline)
+	defer stop()
+	res, err := fn.Func(goja.Undefined(), args[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	if res != nil && !goja.IsUndefined(res) && !goja.IsNull(res) {
+		if err = c.limits.check(res.Export()); err != nil {
+			return nil, fmt.Errorf("result: %v", err)
+		}
+	}
+	return res, nil
+}
+
+func (c *JsContext) call(runtime *goja.Runtime, fn *JsFunction, forceSync bool, values map[string]interface{}, deadline time.Time) (goja.Value, error) {
+	if fn == nil {
+		return nil, nil
+	}
+
+	// build args
+	args := c.args(runtime, fn, values)
+
+	// call javascript func
+	run := func() (goja.Value, error) {
+		return c.run(runtime, fn, args, deadline)
+	}
 
 	// lock RW (if sync || forceSync), R (if state)
-	_, withSync := fn.Params["sync"]
-	withSync = withSync || forceSync
+	withState := fn.Params["state"] > 0
+	withSync := fn.Params["sync"] > 0 || forceSync
 	if withSync {
 		c.mux.Lock()
 		defer c.mux.Unlock()
@@ -203,21 +385,116 @@ func (c *JsContext) call(runtime *goja.Runtime, fn *JsFunction, forceSync bool,
 		defer c.mux.RUnlock()
 	}
 
-	// call javascript func
-	timer := time.AfterFunc(time.Second*time.Duration(c.timeout), func() {
-		runtime.Interrupt(nil)
+	// call without state
+	if !withState {
+		return run()
+	}
+
+	// call with read-only state
+	if !withSync {
+		args[fn.Params["state"]] = ToGojaObject(runtime, c.state.Get())
+		return run()
+	}
+
+	// call with read-write state, keeping object for later export
+	var res goja.Value
+	err := c.state.Update(func(state map[string]interface{}) (map[string]interface{}, error) {
+		stateObject := ToGojaObject(runtime, state)
+		args[fn.Params["state"]] = stateObject
+		var err error
+		res, err = run()
+		if err != nil {
+			return nil, err
+		}
+		newState := stateObject.Export().(map[string]interface{})
+		if err = c.limits.check(newState); err != nil {
+			return nil, fmt.Errorf("state: %v", err)
+		}
+		return newState, nil
 	})
-	res, err := fn.Func(goja.Undefined(), args[1:]...)
-	timer.Stop()
 	if err != nil {
 		return nil, err
 	}
+	return res, nil
+}
+
+// JsBatch is a batch of calls sharing one read-write state, created by JsContext.Batch.
+type JsBatch struct {
+	context *JsContext
+	runtime *JsRuntime
+	state   *goja.Object
+}
 
-	// restore state if it was present
-	if withState {
-		*stateSource = stateObject.Export().(map[string]interface{})
+// Batch calls fn with a batch of calls sharing one read-write state, like a pass over all cached objects,
+// so the state is read and written once instead of once per call, which matters for shared states stored in a ConfigMap.
+//
+// Calls run on the last known state without locking it, so requests are not blocked by long passes,
+// and the state is only updated at the end if calls changed it.
+// If the state has been changed in between, fn is called again on the latest state while locked,
+// so fn must not have side effects other than calls, like patching objects, which must be done once Batch returns.
+func (c *JsContext) Batch(fn func(b *JsBatch) error) error {
+	background := context.Background()
+	object, err := c.pool.BorrowObject(background)
+	if err != nil {
+		return err
 	}
-	return res, nil
+	defer func(pool *pool.ObjectPool, ctx context.Context, object interface{}) {
+		_ = pool.ReturnObject(ctx, object)
+	}(c.pool, background, object)
+	runtime := object.(*JsRuntime)
+
+	// run on last known state
+	state := c.GetState()
+	newState, err := c.runBatch(runtime, state, fn)
+	if err != nil || sameState(state, newState) {
+		return err
+	}
+
+	// update state, running again on latest state if it has changed
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.state.Update(func(latest map[string]interface{}) (map[string]interface{}, error) {
+		if !sameState(latest, state) {
+			state = latest
+			newState, err = c.runBatch(runtime, latest, fn)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return newState, nil
+	})
+}
+
+func (c *JsContext) runBatch(runtime *JsRuntime, state map[string]interface{}, fn func(b *JsBatch) error) (map[string]interface{}, error) {
+	b := &JsBatch{context: c, runtime: runtime, state: ToGojaObject(runtime.Runtime, state).(*goja.Object)}
+	if err := fn(b); err != nil {
+		return nil, err
+	}
+	newState := b.state.Export().(map[string]interface{})
+	if err := c.limits.check(newState); err != nil {
+		return nil, fmt.Errorf("state: %v", err)
+	}
+	return newState, nil
+}
+
+// sameState returns true if states have the same content, ignoring number types changed by JSON decoding.
+func sameState(a map[string]interface{}, b map[string]interface{}) bool {
+	dataA, errA := json.Marshal(a)
+	dataB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(dataA) == string(dataB)
+}
+
+// Call calls a managed function like JsContext.Call, with the state of the batch.
+func (b *JsBatch) Call(method string, values map[string]interface{}) (goja.Value, error) {
+	fn := b.runtime.Methods[method]
+	if fn == nil {
+		return nil, nil
+	}
+	args := b.context.args(b.runtime.Runtime, fn, values)
+	if fn.Params["state"] > 0 {
+		args[fn.Params["state"]] = b.state
+	}
+	return b.context.run(b.runtime.Runtime, fn, args, time.Time{})
 }
 
 func ToMap(obj interface{}) map[string]interface{} {
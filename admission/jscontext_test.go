@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"github.com/dop251/goja"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestJsContext_Objects(t *testing.T) {
@@ -117,3 +119,175 @@ function test(i) {
 		t.Fatalf("failed")
 	}
 }
+
+func TestJsContext_State(t *testing.T) {
+	ctx, err := NewJsContext("test", `
+function jsa_init(state) { state.count = 0 }
+function jsa_created(obj, sync, state) { state.count++ }
+function jsa_deleted(obj, state) { state.count-- }
+`, time.Second, DefaultLimits, NewMemoryBackend(), nil)
+	if err != nil {
+		t.Fatalf("failed")
+	}
+	if _, err = ctx.Call(JsaInit, true, nil); err != nil {
+		t.Fatalf("failed")
+	}
+
+	// test state is updated with sync
+	if _, err = ctx.Call(JsaCreated, false, map[string]interface{}{"sync": true, "obj": nil}); err != nil {
+		t.Fatalf("failed")
+	}
+	if ctx.GetState()["count"] != int64(1) {
+		t.Fatalf("failed")
+	}
+
+	// test state is read-only without sync
+	if _, err = ctx.Call(JsaDeleted, false, map[string]interface{}{"sync": true, "obj": nil}); err != nil {
+		t.Fatalf("failed")
+	}
+	if ctx.GetState()["count"] != int64(1) {
+		t.Fatalf("failed")
+	}
+}
+
+func TestJsContext_Limits(t *testing.T) {
+	limits := Limits{MaxCallStackSize: 100, MaxArrayLength: 10, MaxStringLength: 100}
+	ctx, err := NewJsContext("test", `
+function recurse(n) { return n == 0 ? 0 : 1 + recurse(n - 1) }
+function repeat(n) { return "x".repeat(n) }
+function fill(n) { return new Array(n).fill(0).length }
+function jsa_created(obj, state) { state.items = Array.from({ length: 20 }, function(_, i) { return i }) }
+function jsa_updated(obj, sync, state) { var items = []; for (var i = 0; i < 20; i++) items.push(i); state.items = items }
+function jsa_deleted(obj) { while (true) {} }
+`, time.Second, limits, NewMemoryBackend(), nil)
+	if err != nil {
+		t.Fatalf("failed")
+	}
+
+	// check call stack size
+	if res, err := ctx.CallFunction("recurse", 10); err != nil || res != int64(10) {
+		t.Fatalf("failed")
+	}
+	if _, err = ctx.CallFunction("recurse", 1000); err == nil {
+		t.Fatalf("failed")
+	}
+
+	// check builtins creating large strings and arrays
+	if _, err = ctx.CallFunction("repeat", 10); err != nil {
+		t.Fatalf("failed")
+	}
+	if _, err = ctx.CallFunction("repeat", 1000); err == nil || !strings.Contains(err.Error(), "RangeError") {
+		t.Fatalf("failed %v", err)
+	}
+	if _, err = ctx.CallFunction("fill", 1000000000); err == nil {
+		t.Fatalf("failed")
+	}
+	if _, err = ctx.Call(JsaCreated, false, map[string]interface{}{"sync": true}); err == nil {
+		t.Fatalf("failed")
+	}
+
+	// check large values are not stored in state
+	if _, err = ctx.Call(JsaUpdated, false, map[string]interface{}{"sync": true}); err == nil || ctx.GetState()["items"] != nil {
+		t.Fatalf("failed")
+	}
+
+	// check deadline interrupts calls before the timeout
+	start := time.Now()
+	_, err = ctx.CallBefore(JsaDeleted, false, nil, start.Add(50*time.Millisecond))
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("failed %v", err)
+	}
+}
+
+// countingBackend counts updates, and changes the state on the first update like another replica.
+type countingBackend struct {
+	MemoryBackend
+	updates  int
+	conflict bool
+}
+
+func (b *countingBackend) Update(fn func(state map[string]interface{}) (map[string]interface{}, error)) error {
+	b.updates++
+	if b.conflict {
+		b.conflict = false
+		b.state = map[string]interface{}{"count": int64(10)}
+	}
+	return b.MemoryBackend.Update(fn)
+}
+
+func TestJsContext_Batch(t *testing.T) {
+	backend := &countingBackend{MemoryBackend: MemoryBackend{state: map[string]interface{}{}}}
+	ctx, err := NewJsContext("test", `
+function jsa_created(obj, sync, state) { state.count = (state.count || 0) + 1 }
+function jsa_validate(obj, sync, state) { return { Allowed: state.count > 0 } }
+`, time.Second, DefaultLimits, backend, nil)
+	if err != nil {
+		t.Fatalf("failed")
+	}
+
+	// check state is updated once for all calls
+	calls := 0
+	err = ctx.Batch(func(b *JsBatch) error {
+		for i := 0; i < 3; i++ {
+			calls++
+			if _, err := b.Call(JsaCreated, map[string]interface{}{"sync": true}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || backend.updates != 1 || calls != 3 || ctx.GetState()["count"] != int64(3) {
+		t.Fatalf("failed")
+	}
+
+	// check state is not updated if unchanged
+	err = ctx.Batch(func(b *JsBatch) error {
+		res, err := b.Call(JsaValidate, map[string]interface{}{"sync": true})
+		if err != nil || !res.ToObject(nil).Get("Allowed").ToBoolean() {
+			t.Fatalf("failed")
+		}
+		return err
+	})
+	if err != nil || backend.updates != 1 {
+		t.Fatalf("failed")
+	}
+
+	// check calls run again on the latest state if it has changed in between
+	backend.conflict = true
+	calls = 0
+	err = ctx.Batch(func(b *JsBatch) error {
+		calls++
+		_, err := b.Call(JsaCreated, map[string]interface{}{"sync": true})
+		return err
+	})
+	if err != nil || calls != 2 || ctx.GetState()["count"] != int64(11) {
+		t.Fatalf("failed")
+	}
+}
+
+func TestJsContext_Interrupt(t *testing.T) {
+	// no timeout uses the default timeout, instead of interrupting all calls
+	ctx, err := NewJsContext("test", `function jsa_created(obj) { return 1 }`, 0, DefaultLimits, NewMemoryBackend(), nil)
+	if err != nil || ctx.timeout != DefaultTimeout {
+		t.Fatalf("failed")
+	}
+	if res, err := ctx.Call(JsaCreated, false, nil); err != nil || res.ToInteger() != 1 {
+		t.Fatalf("failed %v", err)
+	}
+
+	// exceeded deadline interrupts calls immediately
+	if _, err = ctx.CallBefore(JsaCreated, false, nil, time.Now().Add(-time.Second)); err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Fatalf("failed %v", err)
+	}
+
+	// timers firing while the call ends never interrupt the next call on the same runtime
+	runtime := goja.New()
+	for i := 0; i < 1000; i++ {
+		stop := ctx.interruptAfter(runtime, time.Now().Add(time.Duration(i%50)*time.Microsecond))
+		time.Sleep(time.Duration(i%60) * time.Microsecond)
+		stop()
+		if _, err = runtime.RunString("1"); err != nil {
+			t.Fatalf("failed %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package admission
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/dop251/goja/ast"
+)
+
+// JsaTestPrefix is the prefix of javascript test functions, like jsa_test_mutate, only run by the test command.
+const JsaTestPrefix = "jsa_test_"
+
+// testHelpers declares assert, expect and fixtures, only available to test functions.
+var testHelpers = goja.MustCompile("jsa_test_helpers", `
+(function (global) {
+	function AssertionError(message) {
+		this.name = "AssertionError";
+		this.message = message;
+	}
+	AssertionError.prototype = Object.create(Error.prototype);
+	AssertionError.prototype.constructor = AssertionError;
+
+	function sorted(value) {
+		if (Array.isArray(value)) return value.map(sorted);
+		if (value !== null && typeof value === "object") {
+			var res = {};
+			Object.keys(value).sort().forEach(function (key) { res[key] = sorted(value[key]); });
+			return res;
+		}
+		return value;
+	}
+	function stringify(value) {
+		if (value === undefined) return "undefined";
+		if (typeof value === "function") return "function";
+		return JSON.stringify(sorted(value));
+	}
+	function fail(message, defaultMessage) {
+		throw new AssertionError(message || defaultMessage);
+	}
+
+	function assert(value, message) {
+		if (!value) fail(message, "expected " + stringify(value) + " to be truthy");
+	}
+	assert.equal = function (actual, expected, message) {
+		if (actual !== expected) fail(message, "expected " + stringify(expected) + ", got " + stringify(actual));
+	};
+	assert.notEqual = function (actual, expected, message) {
+		if (actual === expected) fail(message, "expected not " + stringify(expected));
+	};
+	assert.deepEqual = function (actual, expected, message) {
+		if (stringify(actual) !== stringify(expected)) fail(message, "expected " + stringify(expected) + ", got " + stringify(actual));
+	};
+	assert.throws = function (fn, message) {
+		try {
+			fn();
+		} catch (e) {
+			return e;
+		}
+		fail(message, "expected function to throw");
+	};
+	assert.fail = function (message) {
+		fail(message, "failed");
+	};
+
+	function Expectation(actual, negate) {
+		this.actual = actual;
+		this.negate = negate;
+		if (!negate) this.not = new Expectation(actual, true);
+	}
+	Expectation.prototype.check = function (ok, message) {
+		if (ok === this.negate) fail("expected " + stringify(this.actual) + (this.negate ? " not " : " ") + message);
+	};
+	Expectation.prototype.toBe = function (expected) {
+		this.check(this.actual === expected, "to be " + stringify(expected));
+	};
+	Expectation.prototype.toEqual = function (expected) {
+		this.check(stringify(this.actual) === stringify(expected), "to equal " + stringify(expected));
+	};
+	Expectation.prototype.toBeTruthy = function () {
+		this.check(!!this.actual, "to be truthy");
+	};
+	Expectation.prototype.toBeFalsy = function () {
+		this.check(!this.actual, "to be falsy");
+	};
+	Expectation.prototype.toBeNull = function () {
+		this.check(this.actual === null, "to be null");
+	};
+	Expectation.prototype.toBeUndefined = function () {
+		this.check(this.actual === undefined, "to be undefined");
+	};
+	Expectation.prototype.toBeDefined = function () {
+		this.check(this.actual !== undefined, "to be defined");
+	};
+	Expectation.prototype.toContain = function (item) {
+		var found = false;
+		if (typeof this.actual === "string") found = this.actual.indexOf(item) >= 0;
+		else if (Array.isArray(this.actual)) found = this.actual.some(function (v) { return stringify(v) === stringify(item); });
+		this.check(found, "to contain " + stringify(item));
+	};
+	Expectation.prototype.toHaveProperty = function (path, value) {
+		var current = this.actual;
+		var parts = path.split(".");
+		for (var i = 0; i < parts.length; i++) {
+			if (current === null || typeof current !== "object" || !(parts[i] in current)) {
+				current = undefined;
+				break;
+			}
+			current = current[parts[i]];
+		}
+		if (arguments.length < 2) this.check(current !== undefined, "to have property " + path);
+		else this.check(stringify(current) === stringify(value), "to have property " + path + " = " + stringify(value));
+	};
+	Expectation.prototype.toThrow = function () {
+		var thrown = false;
+		try {
+			this.actual();
+		} catch (e) {
+			thrown = true;
+		}
+		this.check(thrown, "to throw");
+	};
+	function expect(actual) {
+		return new Expectation(actual, false);
+	}
+
+	function merge(target, source) {
+		if (source === null || typeof source !== "object" || Array.isArray(source)) return source;
+		Object.keys(source).forEach(function (key) {
+			var value = source[key];
+			if (value !== null && typeof value === "object" && !Array.isArray(value) && target[key] !== null && typeof target[key] === "object" && !Array.isArray(target[key]))
+				merge(target[key], value);
+			else
+				target[key] = value;
+		});
+		return target;
+	}
+	function name(overrides, defaultName) {
+		return (overrides && overrides.metadata && overrides.metadata.name) || defaultName;
+	}
+	var fixtures = {
+		pod: function (overrides) {
+			var n = name(overrides, "pod");
+			return merge({
+				apiVersion: "v1",
+				kind: "Pod",
+				metadata: { name: n, namespace: "default", uid: n + "-uid", labels: {}, annotations: {} },
+				spec: { containers: [{ name: "main", image: "busybox" }] },
+				status: { phase: "Pending" }
+			}, overrides || {});
+		},
+		deployment: function (overrides) {
+			var n = name(overrides, "deployment");
+			return merge({
+				apiVersion: "apps/v1",
+				kind: "Deployment",
+				metadata: { name: n, namespace: "default", uid: n + "-uid", labels: { app: n }, annotations: {} },
+				spec: {
+					replicas: 1,
+					selector: { matchLabels: { app: n } },
+					template: {
+						metadata: { labels: { app: n } },
+						spec: { containers: [{ name: "main", image: "busybox" }] }
+					}
+				}
+			}, overrides || {});
+		}
+	};
+
+	global.AssertionError = AssertionError;
+	global.assert = assert;
+	global.expect = expect;
+	global.fixtures = fixtures;
+})(this);
+`, false)
+
+// TestResult is the result of a javascript test function, with either a failed assertion or an error.
+type TestResult struct {
+	Name     string
+	Duration time.Duration
+	Failure  string
+	Error    string
+}
+
+// TestFunctions returns the names of the top-level jsa_test_* functions, in declaration order.
+func (c *JsContext) TestFunctions() []string {
+	names := make([]string, 0)
+	for _, stmt := range c.program.Body {
+		if decl, ok := stmt.(*ast.FunctionDeclaration); ok {
+			if name := decl.Function.Name.Name.String(); strings.HasPrefix(name, JsaTestPrefix) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// RunTests calls all jsa_test_* functions, each with a new empty state, and with assert, expect and fixtures helpers.
+func (c *JsContext) RunTests() ([]TestResult, error) {
+	background := context.Background()
+	object, err := c.pool.BorrowObject(background)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = c.pool.ReturnObject(background, object)
+	}()
+	runtime := object.(*JsRuntime).Runtime
+	if _, err = runtime.RunProgram(testHelpers); err != nil {
+		return nil, err
+	}
+
+	results := make([]TestResult, 0)
+	for _, name := range c.TestFunctions() {
+		results = append(results, c.runTest(runtime, name))
+	}
+	return results, nil
+}
+
+func (c *JsContext) runTest(runtime *goja.Runtime, name string) TestResult {
+	result := TestResult{Name: name}
+	fn := analyseFunction(runtime, c.program, name, "state")
+	if fn == nil {
+		result.Error = "not a function"
+		return result
+	}
+	args := make([]goja.Value, fn.Params["state"])
+	for i := range args {
+		args[i] = undefined
+	}
+	if i := fn.Params["state"]; i > 0 {
+		args[i-1] = runtime.NewObject()
+	}
+
+	start := time.Now()
+	stop := c.interruptAfter(runtime, time.Time{})
+	_, err := fn.Func(goja.Undefined(), args...)
+	stop()
+	result.Duration = time.Since(start)
+
+	if exception, ok := err.(*goja.Exception); ok {
+		if obj, ok := exception.Value().(*goja.Object); ok && obj.Get("name") != nil && obj.Get("name").String() == "AssertionError" {
+			result.Failure = obj.Get("message").String()
+			return result
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
@@ -0,0 +1,58 @@
+package admission
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJsTest_RunTests(t *testing.T) {
+	js := `
+function jsa_mutate(op, obj, sync, state) {
+	state.count = (state.count || 0) + 1
+	obj.metadata.labels.count = "" + state.count
+	return { Allowed: true, Result: obj }
+}
+function jsa_test_mutate(state) {
+	var res = jsa_mutate("CREATE", fixtures.pod({ metadata: { name: "p1" } }), true, state)
+	expect(res.Result.metadata.labels.count).toBe("1")
+	expect(res.Result.metadata.name).toBe("p1")
+	expect(res.Result.spec.containers.length).toBe(1)
+	assert.deepEqual(state, { count: 1 })
+}
+function jsa_test_state(state) {
+	expect(state).toEqual({})
+	expect(fixtures.deployment().spec.selector.matchLabels).toEqual({ app: "deployment" })
+}
+function jsa_test_failure() {
+	expect([1, 2]).not.toContain(2)
+}
+function jsa_test_error() {
+	undefinedFunction()
+}
+function jsa_testing() {
+}
+`
+	ctx, err := NewJsContext("test", js, 10*time.Second, DefaultLimits, NewMemoryBackend(), nil)
+	if err != nil {
+		t.Fatalf("failed")
+	}
+	if len(ctx.TestFunctions()) != 4 {
+		t.Fatalf("failed")
+	}
+	results, err := ctx.RunTests()
+	if err != nil || len(results) != 4 {
+		t.Fatalf("failed")
+	}
+	if results[0].Name != "jsa_test_mutate" || results[0].Failure != "" || results[0].Error != "" {
+		t.Fatalf("failed %v", results[0])
+	}
+	if results[1].Failure != "" || results[1].Error != "" {
+		t.Fatalf("failed %v", results[1])
+	}
+	if results[2].Failure != "expected [1,2] not to contain 2" || results[2].Error != "" {
+		t.Fatalf("failed %v", results[2])
+	}
+	if results[3].Failure != "" || results[3].Error == "" {
+		t.Fatalf("failed %v", results[3])
+	}
+}
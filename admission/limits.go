@@ -0,0 +1,138 @@
+package admission
+
+import (
+	"fmt"
+
+	"github.com/dop251/goja"
+)
+
+// Limits are limits of javascript execution, protecting the controller from runaway code.
+//
+// Sizes are only checked by builtins creating large values from small arguments, like "x".repeat(n),
+// and on values returned by functions or stored in state. Other allocations are only bounded by the timeout.
+type Limits struct {
+	// MaxCallStackSize is the max depth of nested calls, 0 for no limit
+	MaxCallStackSize int
+	// MaxArrayLength is the max length of arrays, 0 for no limit
+	MaxArrayLength int
+	// MaxStringLength is the max length of strings in bytes, 0 for no limit
+	MaxStringLength int
+}
+
+// DefaultLimits are the limits used when an admission has no limits.
+var DefaultLimits = Limits{MaxCallStackSize: 1000, MaxArrayLength: 1 << 20, MaxStringLength: 16 << 20}
+
+// apply sets the max call stack size of the runtime and wraps builtins creating large values.
+func (l Limits) apply(runtime *goja.Runtime) error {
+	if l.MaxCallStackSize > 0 {
+		runtime.SetMaxCallStackSize(l.MaxCallStackSize)
+	}
+	rangeError := func(format string, a ...interface{}) *goja.Object {
+		obj, err := runtime.New(runtime.Get("RangeError"), runtime.ToValue(fmt.Sprintf(format, a...)))
+		if err != nil {
+			return runtime.NewTypeError(fmt.Sprintf(format, a...))
+		}
+		return obj
+	}
+
+	// strings: repeat multiplies the length, padStart and padEnd set it
+	if l.MaxStringLength > 0 {
+		max := float64(l.MaxStringLength)
+		err := wrapBuiltin(runtime, "String", true, "repeat", func(call goja.FunctionCall) {
+			if float64(len(call.This.String()))*call.Argument(0).ToFloat() > max {
+				panic(rangeError("string length exceeds %d", l.MaxStringLength))
+			}
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range []string{"padStart", "padEnd"} {
+			err = wrapBuiltin(runtime, "String", true, name, func(call goja.FunctionCall) {
+				if call.Argument(0).ToFloat() > max {
+					panic(rangeError("string length exceeds %d", l.MaxStringLength))
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// arrays: fill allocates sparse arrays like new Array(n), from allocates array-likes like { length: n }
+	if l.MaxArrayLength > 0 {
+		max := float64(l.MaxArrayLength)
+		length := func(v goja.Value) float64 {
+			if obj, ok := v.(*goja.Object); ok {
+				if length := obj.Get("length"); length != nil {
+					return length.ToFloat()
+				}
+			}
+			return 0
+		}
+		err := wrapBuiltin(runtime, "Array", true, "fill", func(call goja.FunctionCall) {
+			if length(call.This) > max {
+				panic(rangeError("array length exceeds %d", l.MaxArrayLength))
+			}
+		})
+		if err != nil {
+			return err
+		}
+		err = wrapBuiltin(runtime, "Array", false, "from", func(call goja.FunctionCall) {
+			if length(call.Argument(0)) > max {
+				panic(rangeError("array length exceeds %d", l.MaxArrayLength))
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrapBuiltin replaces a builtin function of a global constructor, or of its prototype, by a function calling check before it.
+func wrapBuiltin(runtime *goja.Runtime, global string, prototype bool, name string, check func(call goja.FunctionCall)) error {
+	target := runtime.Get(global).ToObject(runtime)
+	if prototype {
+		target = target.Get("prototype").ToObject(runtime)
+	}
+	builtin, ok := goja.AssertFunction(target.Get(name))
+	if !ok {
+		return fmt.Errorf("builtin %s.%s not found", global, name)
+	}
+	wrapper := runtime.ToValue(func(call goja.FunctionCall) goja.Value {
+		check(call)
+		res, err := builtin(call.This, call.Arguments...)
+		if err != nil {
+			panic(err)
+		}
+		return res
+	})
+	// builtins are not enumerable
+	return target.DefineDataProperty(name, wrapper, goja.FLAG_TRUE, goja.FLAG_FALSE, goja.FLAG_TRUE)
+}
+
+// check returns an error if an exported value contains arrays or strings larger than limits.
+func (l Limits) check(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		if l.MaxStringLength > 0 && len(v) > l.MaxStringLength {
+			return fmt.Errorf("string length %d exceeds %d", len(v), l.MaxStringLength)
+		}
+	case []interface{}:
+		if l.MaxArrayLength > 0 && len(v) > l.MaxArrayLength {
+			return fmt.Errorf("array length %d exceeds %d", len(v), l.MaxArrayLength)
+		}
+		for _, item := range v {
+			if err := l.check(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			if err := l.check(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
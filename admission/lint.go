@@ -0,0 +1,99 @@
+package admission
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dop251/goja"
+	"github.com/dop251/goja/ast"
+	"github.com/dop251/goja/parser"
+)
+
+// JsaPrefix is the prefix of functions managed by the runtime, reserved for them.
+const JsaPrefix = "jsa_"
+
+// maxParameters is the number of parameters passed to managed functions.
+const maxParameters = 4
+
+// runtimeFunctions are utilities added by the runtime, which must not be redeclared.
+var runtimeFunctions = map[string]bool{
+	"jsa_log":    true,
+	"jsa_logf":   true,
+	"jsa_debug":  true,
+	"jsa_debugf": true,
+	"jsa_lookup": true,
+}
+
+// Lint parses and compiles javascript code, and checks its jsa_* functions, returning problems found.
+//
+// Functions listed in required must be declared, like index functions.
+func Lint(js string, required ...string) []string {
+	problems := make([]string, 0)
+	program, err := goja.Parse("", js, parser.WithDisableSourceMaps)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	if _, err = goja.CompileAST(program, false); err != nil {
+		return append(problems, err.Error())
+	}
+
+	declared := make(map[string]bool)
+	for _, stmt := range program.Body {
+		decl, ok := stmt.(*ast.FunctionDeclaration)
+		if !ok {
+			continue
+		}
+		name := decl.Function.Name.Name.String()
+		declared[name] = true
+		if !strings.HasPrefix(name, JsaPrefix) {
+			continue
+		}
+		parameters, managed := functionParameters[name]
+		switch {
+		case runtimeFunctions[name]:
+			problems = append(problems, fmt.Sprintf("%s: redeclares a function of the runtime", name))
+			continue
+		case strings.HasPrefix(name, JsaTestPrefix):
+			parameters = []string{"state"}
+		case !managed:
+			problems = append(problems, fmt.Sprintf("%s: unknown function, %s prefix is reserved to functions managed by the runtime", name, JsaPrefix))
+			continue
+		}
+		problems = append(problems, lintParameters(name, decl, parameters)...)
+	}
+
+	for _, name := range required {
+		if !declared[name] {
+			problems = append(problems, fmt.Sprintf("%s: function not found", name))
+		}
+	}
+	return problems
+}
+
+// lintParameters checks parameters are known by analyseFunction, and in the passed parameters.
+func lintParameters(name string, decl *ast.FunctionDeclaration, parameters []string) []string {
+	problems := make([]string, 0)
+	known := make(map[string]bool)
+	for _, parameter := range parameters {
+		known[parameter] = true
+	}
+	for index, binding := range decl.Function.ParameterList.List {
+		identifier, ok := binding.Target.(*ast.Identifier)
+		if !ok || binding.Initializer != nil {
+			problems = append(problems, fmt.Sprintf("%s: parameter %d must be a plain name, one of %s", name, index+1, strings.Join(parameters, ", ")))
+			continue
+		}
+		parameter := identifier.Name.String()
+		if !known[parameter] {
+			problems = append(problems, fmt.Sprintf("%s: unknown parameter %s, expected one of %s", name, parameter, strings.Join(parameters, ", ")))
+			continue
+		}
+		if index >= maxParameters {
+			problems = append(problems, fmt.Sprintf("%s: parameter %s is at position %d, only the first %d parameters are passed", name, parameter, index+1, maxParameters))
+		}
+	}
+	if decl.Function.ParameterList.Rest != nil {
+		problems = append(problems, fmt.Sprintf("%s: rest parameter is not supported", name))
+	}
+	return problems
+}
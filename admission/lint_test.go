@@ -0,0 +1,49 @@
+package admission
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	// valid code
+	problems := Lint(`
+function jsa_mutate(op, obj, state, sync) { return }
+function jsa_deleted(obj, inferred) {}
+function jsa_test_mutate(state) {}
+function byNode(obj) { return obj.spec.nodeName }
+`, "byNode")
+	if len(problems) != 0 {
+		t.Fatalf("failed %v", problems)
+	}
+
+	// syntax error
+	problems = Lint(`function jsa_mutate(op, obj { }`)
+	if len(problems) != 1 {
+		t.Fatalf("failed")
+	}
+
+	// invalid functions
+	problems = Lint(`
+function jsa_mutate(op, object) {}
+function jsa_validate(a, b, c, d, op) {}
+function jsa_helper() {}
+function jsa_log(s) {}
+function jsa_init({ state }) {}
+`, "byNode")
+	expected := []string{
+		"jsa_mutate: unknown parameter object",
+		"jsa_validate: unknown parameter a",
+		"jsa_validate: parameter op is at position 5",
+		"jsa_helper: unknown function",
+		"jsa_log: redeclares a function of the runtime",
+		"jsa_init: parameter 1 must be a plain name",
+		"byNode: function not found",
+	}
+	all := strings.Join(problems, "\n")
+	for _, e := range expected {
+		if !strings.Contains(all, e) {
+			t.Fatalf("failed %s in %v", e, problems)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package admission
+
+import (
+	"sync"
+)
+
+// StateBackend stores the state of an admission.
+//
+// The state returned by Get or passed to Update must be considered read-only,
+// as a new state is always returned instead of modifying the existing one.
+type StateBackend interface {
+	// Get returns the last known state.
+	Get() map[string]interface{}
+	// Set replaces the state.
+	Set(state map[string]interface{}) error
+	// Update calls fn with the latest state and stores the returned state.
+	// The implementation may call fn several times, like on concurrent updates.
+	Update(fn func(state map[string]interface{}) (map[string]interface{}, error)) error
+}
+
+// MemoryBackend is the default state backend, where state only lives in memory of the current process.
+type MemoryBackend struct {
+	mux   sync.RWMutex
+	state map[string]interface{}
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		mux:   sync.RWMutex{},
+		state: make(map[string]interface{}),
+	}
+}
+
+func (b *MemoryBackend) Get() map[string]interface{} {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.state
+}
+
+func (b *MemoryBackend) Set(state map[string]interface{}) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.state = state
+	return nil
+}
+
+func (b *MemoryBackend) Update(fn func(state map[string]interface{}) (map[string]interface{}, error)) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	state, err := fn(b.state)
+	if err != nil {
+		return err
+	}
+	b.state = state
+	return nil
+}
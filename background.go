@@ -0,0 +1,91 @@
+package main
+
+import (
+	"time"
+
+	"github.com/momiji/js-admissions-controller/admission"
+	"github.com/momiji/js-admissions-controller/logs"
+	"github.com/momiji/js-admissions-controller/report"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// scanAdmission runs a background scan now and at spec.background.interval, until the admission code is closed.
+//
+// Scans only run on the leader, as they write policy reports.
+func scanAdmission(code *admission.AdmissionCode) {
+	adm := code.Admission
+	ticker := time.NewTicker(adm.Background)
+	defer ticker.Stop()
+	for {
+		if election.IsLeader() {
+			if err := scanObjects(code); err != nil {
+				logs.Errorf("Admissions: background scan %s failed: %v", adm.FullName(), err)
+			}
+		}
+		select {
+		case <-code.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scanObjects calls jsa_validate with op BACKGROUND for all cached objects of the admission kinds matching its selectors,
+// writing a PolicyReport per namespace and a ClusterPolicyReport for cluster objects, and deleting reports without objects anymore.
+//
+// All calls share one state, read and written once per scan.
+func scanObjects(code *admission.AdmissionCode) error {
+	adm := code.Admission
+	objs, err := resyncObjects(adm)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var reports map[string]*report.Report
+	err = code.Batch(func(b *admission.AdmissionBatch) error {
+		reports = make(map[string]*report.Report)
+		for _, obj := range objs {
+			r, ok := reports[obj.GetNamespace()]
+			if !ok {
+				r = report.NewReport("jsa-"+adm.FullName(), obj.GetNamespace(), adm.FullName(), adm.Owner)
+				reports[obj.GetNamespace()] = r
+			}
+			result, message := scanObject(b, obj)
+			r.Add(obj, result, message, now)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logs.Tracef("Admissions: background scan %s objs=%d reports=%d", adm.FullName(), len(objs), len(reports))
+
+	keep := make(map[string]bool)
+	for ns, r := range reports {
+		if err = reportWriter.Write(r); err != nil {
+			return err
+		}
+		keep[ns] = true
+	}
+	return reportWriter.Prune(adm.Owner, keep)
+}
+
+// scanObject returns the result of jsa_validate for an object, skipped if it does not return Allowed.
+func scanObject(b *admission.AdmissionBatch, obj *unstructured.Unstructured) (report.Result, string) {
+	res, err := b.Validate(admission.OperationBackground, obj)
+	if err != nil {
+		return report.Error, err.Error()
+	}
+	if res == nil {
+		return report.Skip, ""
+	}
+	allowed, found, err := unstructured.NestedBool(res.Object, "Allowed")
+	if !found || err != nil {
+		return report.Skip, ""
+	}
+	message, _, _ := unstructured.NestedString(res.Object, "Message")
+	if !allowed {
+		return report.Fail, message
+	}
+	return report.Pass, message
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/momiji/js-admissions-controller/admission"
+	"github.com/momiji/js-admissions-controller/report"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestScanObject(t *testing.T) {
+	js := `
+	function jsa_validate(op, obj) {
+		if (op != "BACKGROUND") return;
+		if (obj.metadata.name == "error") throw new Error("boom");
+		if (obj.metadata.name == "skip") return;
+		return { Allowed: obj.metadata.name == "pass", Message: "checked" }
+	}`
+	adm := newLintAdmission([]interface{}{"pods"}, js)
+	codes, err := loadOfflineAdmissions([]*unstructured.Unstructured{adm}, nil, []schema.GroupVersionKind{{Version: "v1", Kind: "Pod"}})
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	expected := map[string]report.Result{"pass": report.Pass, "fail": report.Fail, "skip": report.Skip, "error": report.Error}
+	err = codes[0].Batch(func(b *admission.AdmissionBatch) error {
+		for name, result := range expected {
+			obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			obj.SetAPIVersion("v1")
+			obj.SetKind("Pod")
+			obj.SetName(name)
+			if res, _ := scanObject(b, obj); res != result {
+				t.Fatalf("failed %s: %s", name, res)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed")
+	}
+}
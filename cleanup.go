@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/admission"
+	"github.com/momiji/js-admissions-controller/logs"
+	"github.com/momiji/js-admissions-controller/utils"
+	"github.com/momiji/js-admissions-controller/watcher"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// cleanupAdmission deletes cached objects selected by jsa_cleanup at each time of spec.cleanup.schedule, until the admission code is closed.
+//
+// Objects are only deleted on the leader.
+func cleanupAdmission(code *admission.AdmissionCode, spec *admissionSpec, resources []watcher.Resource) {
+	adm := code.Admission
+	for {
+		next := spec.CleanupSchedule.Next(time.Now())
+		if next.IsZero() {
+			logs.Errorf("Admissions: cleanup schedule of %s never runs", adm.FullName())
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-code.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if !election.IsLeader() {
+			continue
+		}
+		deleted, failed := cleanupObjects(code, spec, resources)
+		logs.Infof("Admissions: cleanup %s deleted=%d failed=%d dryRun=%v", adm.FullName(), deleted, failed, spec.CleanupDryRun)
+	}
+}
+
+// cleanupCandidate is a cached object selected by jsa_cleanup, or the error of jsa_cleanup.
+type cleanupCandidate struct {
+	resource watcher.Resource
+	obj      *unstructured.Unstructured
+	err      error
+}
+
+// cleanupObjects deletes cached objects of resources for which jsa_cleanup returns true, up to spec.cleanup.maxDeletions,
+// and records an event on the admission for each deleted object.
+//
+// Objects are selected first, sharing one state read and written once per run, then deleted.
+func cleanupObjects(code *admission.AdmissionCode, spec *admissionSpec, resources []watcher.Resource) (int, int) {
+	adm := code.Admission
+	now := time.Now()
+	options := metav1.DeleteOptions{}
+	if spec.CleanupDryRun {
+		options.DryRun = []string{metav1.DryRunAll}
+	}
+	background := metav1.DeletePropagationBackground
+	options.PropagationPolicy = &background
+
+	// select objects, again if the state has been changed in between
+	objs := make([]cleanupCandidate, 0)
+	for _, resource := range resources {
+		for _, obj := range resourcesWatcher.GetResources(utils.GVKToString(resource.GVK), adm.Namespace) {
+			if adm.Matches(obj) {
+				objs = append(objs, cleanupCandidate{resource: resource, obj: obj})
+			}
+		}
+	}
+	var candidates []cleanupCandidate
+	err := code.Batch(func(b *admission.AdmissionBatch) error {
+		candidates = make([]cleanupCandidate, 0)
+		for _, c := range objs {
+			var selected bool
+			selected, c.err = b.Cleanup(c.obj, now)
+			if selected || c.err != nil {
+				candidates = append(candidates, c)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logs.Errorf("Cleanup: %s - Error: %v", adm.FullName(), err)
+		return 0, len(objs)
+	}
+
+	// delete selected objects
+	deleted, failed := 0, 0
+	for _, c := range candidates {
+		resource, obj, err := c.resource, c.obj, c.err
+		if err != nil {
+			logs.Errorf("Cleanup: %s ns=%s name=%s - Error: %v", utils.GVKToString(resource.GVK), obj.GetNamespace(), obj.GetName(), err)
+			failed++
+			continue
+		}
+		if deleted >= spec.CleanupMax {
+			recordEvent(adm, EventWarning, "CleanupLimitReached", fmt.Sprintf("Cleanup stopped after %d deletions, remaining objects are deleted by the next run", spec.CleanupMax))
+			return deleted, failed
+		}
+		if err = deleteObject(resource, obj, options); err != nil {
+			logs.Errorf("Cleanup: %s ns=%s name=%s - Error: %v", utils.GVKToString(resource.GVK), obj.GetNamespace(), obj.GetName(), err)
+			recordEvent(adm, EventWarning, "CleanupFailed", fmt.Sprintf("Failed to delete %s ns=%s name=%s: %v", obj.GetKind(), obj.GetNamespace(), obj.GetName(), err))
+			failed++
+			continue
+		}
+		reason := "Deleted"
+		if spec.CleanupDryRun {
+			reason = "DeletedDryRun"
+		}
+		logs.Infof("Cleanup: %s ns=%s name=%s - %s", utils.GVKToString(resource.GVK), obj.GetNamespace(), obj.GetName(), reason)
+		recordEvent(adm, EventNormal, reason, fmt.Sprintf("Deleted %s ns=%s name=%s", obj.GetKind(), obj.GetNamespace(), obj.GetName()))
+		deleted++
+	}
+	return deleted, failed
+}
+
+// deleteObject deletes an object, only if it has not been replaced by another object with the same name.
+func deleteObject(resource watcher.Resource, obj *unstructured.Unstructured, options metav1.DeleteOptions) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	uid := obj.GetUID()
+	options.Preconditions = &metav1.Preconditions{UID: &uid}
+	err := clusterClient.Resource(resource.GVR).Namespace(obj.GetNamespace()).Delete(ctx, obj.GetName(), options)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse_Invalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "* * * foo *"} {
+		if _, err := Parse(expr); err == nil {
+			t.Fatalf("failed %q", expr)
+		}
+	}
+}
+
+func TestSchedule_Next(t *testing.T) {
+	from := time.Date(2024, 1, 31, 10, 7, 30, 0, time.UTC) // wednesday
+	tests := map[string]time.Time{
+		"* * * * *":            time.Date(2024, 1, 31, 10, 8, 0, 0, time.UTC),
+		"*/15 * * * *":         time.Date(2024, 1, 31, 10, 15, 0, 0, time.UTC),
+		"5/20 * * * *":         time.Date(2024, 1, 31, 10, 25, 0, 0, time.UTC),
+		"0 2 * * *":            time.Date(2024, 2, 1, 2, 0, 0, 0, time.UTC),
+		"@daily":               time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		"@hourly":              time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC),
+		"30 3 * * sat,sun":     time.Date(2024, 2, 3, 3, 30, 0, 0, time.UTC),
+		"0 0 * * 7":            time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC),
+		"0 9-17/4 * * MON-FRI": time.Date(2024, 1, 31, 13, 0, 0, 0, time.UTC),
+		"0 0 29 feb *":         time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+		"0 0 1,15 * *":         time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		// day of month or day of week
+		"0 0 10 * fri": time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC),
+		// never matches
+		"0 0 30 2 *": {},
+	}
+	for expr, expected := range tests {
+		s, err := Parse(expr)
+		if err != nil {
+			t.Fatalf("failed %q: %v", expr, err)
+		}
+		if next := s.Next(from); !next.Equal(expected) {
+			t.Fatalf("failed %q: %v", expr, next)
+		}
+	}
+}
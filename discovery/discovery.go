@@ -2,6 +2,8 @@ package discovery
 
 import (
 	"fmt"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/discovery/cached/memory"
@@ -9,12 +11,23 @@ import (
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/restmapper"
 	"strings"
+	"sync"
+	"time"
 )
 
+// ResetInterval is the minimum interval between resets of the discovery cache on cache miss.
+const ResetInterval = 10 * time.Second
+
 type Discovery struct {
 	discoveryClient *discovery.DiscoveryClient
 	discoveryMapper *restmapper.DeferredDiscoveryRESTMapper
+	cachedClient    discovery.CachedDiscoveryInterface
 	dynamicClient   dynamic.Interface
+	mux             sync.Mutex
+	lastReset       time.Time
+	// staticGroups and staticLists are the resources of a static discovery, without API server
+	staticGroups []*metav1.APIGroup
+	staticLists  []*metav1.APIResourceList
 }
 
 func NewDiscovery(config *rest.Config) (*Discovery, error) {
@@ -34,21 +47,42 @@ func NewDiscovery(config *rest.Config) (*Discovery, error) {
 
 	dm := restmapper.NewDeferredDiscoveryRESTMapper(cacheC)
 
-	return &Discovery{disC, dm, dynC}, nil
+	return &Discovery{discoveryClient: disC, discoveryMapper: dm, cachedClient: cacheC, dynamicClient: dynC, lastReset: time.Now()}, nil
+}
+
+// Reset invalidates the discovery cache, so resources installed later, like CRDs, are discovered.
+func (d *Discovery) Reset() {
+	d.mux.Lock()
+	d.lastReset = time.Now()
+	d.mux.Unlock()
+	d.discoveryMapper.Reset()
+}
+
+// resetOnMiss resets the discovery cache after a cache miss, at most once every ResetInterval, and returns true if it has been reset.
+func (d *Discovery) resetOnMiss() bool {
+	if d.discoveryMapper == nil {
+		return false
+	}
+	d.mux.Lock()
+	if time.Since(d.lastReset) < ResetInterval {
+		d.mux.Unlock()
+		return false
+	}
+	d.mux.Unlock()
+	d.Reset()
+	return true
 }
 
 func (d *Discovery) GetGVRFromResource(resource string) (schema.GroupVersionResource, error) {
-	var gvr schema.GroupVersionResource
-	if strings.Count(resource, "/") >= 2 {
-		s := strings.SplitN(resource, "/", 3)
-		gvr = schema.GroupVersionResource{Group: s[0], Version: s[1], Resource: s[2]}
-	} else if strings.Count(resource, "/") == 1 {
-		s := strings.SplitN(resource, "/", 2)
-		gvr = schema.GroupVersionResource{Group: "", Version: s[0], Resource: s[1]}
-	} else {
-		gvr = schema.GroupVersionResource{Group: "", Version: "", Resource: resource}
+	gvr := parseResource(resource)
+	res, err := d.resourceFor(resource, gvr)
+	if err != nil && d.resetOnMiss() {
+		res, err = d.resourceFor(resource, gvr)
 	}
+	return res, err
+}
 
+func (d *Discovery) resourceFor(resource string, gvr schema.GroupVersionResource) (schema.GroupVersionResource, error) {
 	gvrs, err := d.discoveryMapper.ResourcesFor(gvr)
 	if err != nil {
 		return schema.GroupVersionResource{}, err
@@ -62,25 +96,44 @@ func (d *Discovery) GetGVRFromResource(resource string) (schema.GroupVersionReso
 }
 
 func (d *Discovery) GetGVKFromResource(resource string) (schema.GroupVersionKind, error) {
-	var gvr schema.GroupVersionResource
-	if strings.Count(resource, "/") >= 2 {
-		s := strings.SplitN(resource, "/", 3)
-		gvr = schema.GroupVersionResource{Group: s[0], Version: s[1], Resource: s[2]}
-	} else if strings.Count(resource, "/") == 1 {
-		s := strings.SplitN(resource, "/", 2)
-		gvr = schema.GroupVersionResource{Group: "", Version: s[0], Resource: s[1]}
-	} else {
-		gvr = schema.GroupVersionResource{Group: "", Version: "", Resource: resource}
+	gvr := parseResource(resource)
+	res, err := d.kindFor(resource, gvr)
+	if err != nil && d.resetOnMiss() {
+		res, err = d.kindFor(resource, gvr)
 	}
+	return res, err
+}
 
-	gvrs, err := d.discoveryMapper.KindsFor(gvr)
+func (d *Discovery) kindFor(resource string, gvr schema.GroupVersionResource) (schema.GroupVersionKind, error) {
+	gvks, err := d.discoveryMapper.KindsFor(gvr)
 	if err != nil {
 		return schema.GroupVersionKind{}, err
 	}
 
-	if len(gvrs) == 0 {
+	if len(gvks) == 0 {
 		return schema.GroupVersionKind{}, fmt.Errorf("unable to find resource %s", resource)
 	}
 
-	return gvrs[0], nil
+	return gvks[0], nil
+}
+
+// parseResource parses a resource like group/version/resource, version/resource or resource.
+func parseResource(resource string) schema.GroupVersionResource {
+	if strings.Count(resource, "/") >= 2 {
+		s := strings.SplitN(resource, "/", 3)
+		return schema.GroupVersionResource{Group: s[0], Version: s[1], Resource: s[2]}
+	} else if strings.Count(resource, "/") == 1 {
+		s := strings.SplitN(resource, "/", 2)
+		return schema.GroupVersionResource{Group: "", Version: s[0], Resource: s[1]}
+	}
+	return schema.GroupVersionResource{Group: "", Version: "", Resource: resource}
+}
+
+// IsNamespaced returns true if objects of this kind are in a namespace.
+func (d *Discovery) IsNamespaced(gvk schema.GroupVersionKind) (bool, error) {
+	mapping, err := d.discoveryMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return false, err
+	}
+	return mapping.Scope.Name() == meta.RESTScopeNameNamespace, nil
 }
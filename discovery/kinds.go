@@ -0,0 +1,265 @@
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+// Kind is a kind resolved from a pattern of spec.kinds.
+type Kind struct {
+	GVR schema.GroupVersionResource
+	GVK schema.GroupVersionKind
+	// Subresource is the subresource, like exec or status, or empty for a resource
+	Subresource string
+	Namespaced  bool
+	// Watchable is true if objects can be listed and watched, which is never the case for subresources
+	Watchable bool
+}
+
+// apiResource is a resource or subresource served by the API server.
+type apiResource struct {
+	group       string
+	version     string
+	preferred   bool
+	resource    metav1.APIResource
+	name        string
+	subresource string
+}
+
+// ResolveKinds returns all kinds matching a pattern like:
+//   - resource, kind or short name: pods, Pod, po, deployments, Deployment, deploy
+//   - version/resource or group/version/resource: v1/pods, apps/v1/deployments
+//   - resource/subresource, version/resource/subresource or group/version/resource/subresource: pods/exec, v1/pods/status
+//
+// Any part can be *, like apps/*/deployments for all served versions, or */*/* for all resources.
+// Without version, only the preferred version of each group is used.
+func (d *Discovery) ResolveKinds(pattern string) ([]Kind, error) {
+	kinds, err := d.resolveKinds(pattern)
+	if (err != nil || len(kinds) == 0) && d.resetOnMiss() {
+		kinds, err = d.resolveKinds(pattern)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(kinds) == 0 {
+		return nil, fmt.Errorf("unable to find resource %s", pattern)
+	}
+	return kinds, nil
+}
+
+func (d *Discovery) resolveKinds(pattern string) ([]Kind, error) {
+	if d.cachedClient == nil {
+		return matchKinds(pattern, apiResources(d.staticGroups, d.staticLists)), nil
+	}
+	groups, lists, err := d.cachedClient.ServerGroupsAndResources()
+	if err != nil && len(lists) == 0 {
+		return nil, err
+	}
+	return matchKinds(pattern, apiResources(groups, lists)), nil
+}
+
+// NewStaticDiscovery returns a discovery only knowing these kinds, without API server, like for offline tests.
+//
+// Resources are guessed from kinds, like pods for Pod, and the preferred version of a group is its latest version.
+func NewStaticDiscovery(gvks []schema.GroupVersionKind) *Discovery {
+	preferred := make(map[string]string)
+	resources := make(map[string][]metav1.APIResource)
+	known := make(map[schema.GroupVersionKind]bool)
+	for _, gvk := range gvks {
+		if known[gvk] {
+			continue
+		}
+		known[gvk] = true
+		if v, ok := preferred[gvk.Group]; !ok || version.CompareKubeAwareVersionStrings(gvk.Version, v) > 0 {
+			preferred[gvk.Group] = gvk.Version
+		}
+		plural, singular := meta.UnsafeGuessKindToResource(gvk)
+		gv := gvk.GroupVersion().String()
+		resources[gv] = append(resources[gv], metav1.APIResource{
+			Name:         plural.Resource,
+			SingularName: singular.Resource,
+			Kind:         gvk.Kind,
+			Namespaced:   true,
+			Verbs:        []string{"get", "list", "watch"},
+		})
+	}
+	d := &Discovery{}
+	for group, v := range preferred {
+		gv := schema.GroupVersion{Group: group, Version: v}.String()
+		d.staticGroups = append(d.staticGroups, &metav1.APIGroup{Name: group, PreferredVersion: metav1.GroupVersionForDiscovery{GroupVersion: gv, Version: v}})
+	}
+	// sort groups so that the first matched group of ambiguous names does not depend on map order
+	gvs := make([]string, 0)
+	for gv := range resources {
+		gvs = append(gvs, gv)
+	}
+	sort.Strings(gvs)
+	for _, gv := range gvs {
+		d.staticLists = append(d.staticLists, &metav1.APIResourceList{GroupVersion: gv, APIResources: resources[gv]})
+	}
+	return d
+}
+
+// apiResources flattens the resources served by the API server.
+func apiResources(groups []*metav1.APIGroup, lists []*metav1.APIResourceList) []apiResource {
+	preferred := make(map[string]string)
+	for _, group := range groups {
+		preferred[group.Name] = group.PreferredVersion.Version
+	}
+	resources := make([]apiResource, 0)
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+		for _, resource := range list.APIResources {
+			name, subresource, _ := strings.Cut(resource.Name, "/")
+			resources = append(resources, apiResource{
+				group:       gv.Group,
+				version:     gv.Version,
+				preferred:   preferred[gv.Group] == gv.Version,
+				resource:    resource,
+				name:        name,
+				subresource: subresource,
+			})
+		}
+	}
+	return resources
+}
+
+// matchKinds returns the kinds of resources matching the pattern, using the first layout of parts with matches.
+//
+// Names without group matching resources of several groups, like events in core and events.k8s.io, only use one group.
+func matchKinds(pattern string, resources []apiResource) []Kind {
+	parts := strings.Split(pattern, "/")
+	var layouts [][]string
+	switch len(parts) {
+	case 1:
+		layouts = [][]string{{"resource"}}
+	case 2:
+		layouts = [][]string{{"version", "resource"}, {"resource", "subresource"}}
+	case 3:
+		layouts = [][]string{{"group", "version", "resource"}, {"version", "resource", "subresource"}}
+	case 4:
+		layouts = [][]string{{"group", "version", "resource", "subresource"}}
+	}
+	for _, layout := range layouts {
+		matched := make([]apiResource, 0)
+		for _, resource := range resources {
+			if matchLayout(layout, parts, resource) {
+				matched = append(matched, resource)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		if layout[0] != "group" && !matchesAll(layout, parts) {
+			matched = preferGroup(matched)
+		}
+		kinds := make([]Kind, 0)
+		for _, resource := range matched {
+			kinds = append(kinds, resource.kind())
+		}
+		return kinds
+	}
+	return nil
+}
+
+// matchesAll returns true if the resource part of the layout is *.
+func matchesAll(layout []string, parts []string) bool {
+	for i, name := range layout {
+		if name == "resource" {
+			return parts[i] == "*"
+		}
+	}
+	return false
+}
+
+// preferGroup keeps only the resources of one group, the core group if matched, else the first matched group in discovery order like kubectl.
+func preferGroup(resources []apiResource) []apiResource {
+	group := resources[0].group
+	for _, resource := range resources {
+		if resource.group == "" {
+			group = ""
+			break
+		}
+	}
+	kept := make([]apiResource, 0)
+	for _, resource := range resources {
+		if resource.group == group {
+			kept = append(kept, resource)
+		}
+	}
+	return kept
+}
+
+func matchLayout(layout []string, parts []string, resource apiResource) bool {
+	values := make(map[string]string)
+	for i, name := range layout {
+		values[name] = parts[i]
+	}
+	group, hasGroup := values["group"]
+	version, hasVersion := values["version"]
+	subresource, hasSubresource := values["subresource"]
+	if hasGroup && group != "*" && group != resource.group && !(group == "core" && resource.group == "") {
+		return false
+	}
+	if hasVersion && version != "*" && version != resource.version {
+		return false
+	}
+	if !hasVersion && !resource.preferred {
+		return false
+	}
+	if hasSubresource && subresource == "*" {
+		return resource.subresource != "" && matchName(values["resource"], resource)
+	}
+	if subresource != resource.subresource {
+		return false
+	}
+	return matchName(values["resource"], resource)
+}
+
+// matchName matches a resource by name, singular name, kind or short name, ignoring case.
+func matchName(name string, resource apiResource) bool {
+	if name == "*" || strings.EqualFold(name, resource.name) {
+		return true
+	}
+	// subresources have no names, but the kind of the subresource
+	if resource.subresource != "" {
+		return false
+	}
+	if strings.EqualFold(name, resource.resource.SingularName) || strings.EqualFold(name, resource.resource.Kind) {
+		return true
+	}
+	for _, shortName := range resource.resource.ShortNames {
+		if strings.EqualFold(name, shortName) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r apiResource) kind() Kind {
+	// subresources may have another group and version, like autoscaling/v1 for scale
+	group, version := r.group, r.version
+	if r.resource.Group != "" || r.resource.Version != "" {
+		group, version = r.resource.Group, r.resource.Version
+	}
+	verbs := make(map[string]bool)
+	for _, verb := range r.resource.Verbs {
+		verbs[verb] = true
+	}
+	return Kind{
+		GVR:         schema.GroupVersionResource{Group: r.group, Version: r.version, Resource: r.name},
+		GVK:         schema.GroupVersionKind{Group: group, Version: version, Kind: r.resource.Kind},
+		Subresource: r.subresource,
+		Namespaced:  r.resource.Namespaced,
+		Watchable:   r.subresource == "" && verbs["list"] && verbs["watch"],
+	}
+}
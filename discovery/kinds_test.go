@@ -0,0 +1,112 @@
+package discovery
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var testGroups = []*metav1.APIGroup{
+	{Name: "", PreferredVersion: metav1.GroupVersionForDiscovery{GroupVersion: "v1", Version: "v1"}},
+	{Name: "apps", PreferredVersion: metav1.GroupVersionForDiscovery{GroupVersion: "apps/v1", Version: "v1"}},
+	{Name: "events.k8s.io", PreferredVersion: metav1.GroupVersionForDiscovery{GroupVersion: "events.k8s.io/v1", Version: "v1"}},
+}
+
+var testLists = []*metav1.APIResourceList{
+	{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "pods", SingularName: "pod", Kind: "Pod", Namespaced: true, ShortNames: []string{"po"}, Verbs: []string{"get", "list", "watch"}},
+			{Name: "pods/exec", Kind: "PodExecOptions", Namespaced: true, Verbs: []string{"create", "get"}},
+			{Name: "pods/status", Kind: "Pod", Namespaced: true, Verbs: []string{"get", "patch", "update"}},
+			{Name: "nodes", SingularName: "node", Kind: "Node", ShortNames: []string{"no"}, Verbs: []string{"get", "list", "watch"}},
+			{Name: "events", SingularName: "event", Kind: "Event", Namespaced: true, ShortNames: []string{"ev"}, Verbs: []string{"get", "list", "watch"}},
+		},
+	},
+	{
+		GroupVersion: "apps/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "deployments", SingularName: "deployment", Kind: "Deployment", Namespaced: true, ShortNames: []string{"deploy"}, Verbs: []string{"get", "list", "watch"}},
+			{Name: "deployments/scale", Group: "autoscaling", Version: "v1", Kind: "Scale", Namespaced: true, Verbs: []string{"get", "update"}},
+		},
+	},
+	{
+		GroupVersion: "apps/v1beta1",
+		APIResources: []metav1.APIResource{
+			{Name: "deployments", SingularName: "deployment", Kind: "Deployment", Namespaced: true, Verbs: []string{"get", "list", "watch"}},
+		},
+	},
+	{
+		GroupVersion: "events.k8s.io/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "events", SingularName: "event", Kind: "Event", Namespaced: true, ShortNames: []string{"ev"}, Verbs: []string{"get", "list", "watch"}},
+		},
+	},
+}
+
+func testMatch(pattern string) string {
+	gvks := make([]string, 0)
+	for _, kind := range matchKinds(pattern, apiResources(testGroups, testLists)) {
+		gvks = append(gvks, kind.GVK.String())
+	}
+	sort.Strings(gvks)
+	return strings.Join(gvks, ";")
+}
+
+func TestKinds_Names(t *testing.T) {
+	for _, pattern := range []string{"pods", "pod", "Pod", "po", "v1/pods", "core/v1/pods", "/v1/pods"} {
+		if testMatch(pattern) != "/v1, Kind=Pod" {
+			t.Fatalf("failed %s: %s", pattern, testMatch(pattern))
+		}
+	}
+	if testMatch("deploy") != "apps/v1, Kind=Deployment" {
+		t.Fatalf("failed")
+	}
+	if testMatch("unknown") != "" || testMatch("apps/v1/pods") != "" {
+		t.Fatalf("failed")
+	}
+
+	// names in several groups use the core group, unless the group is set
+	if testMatch("events") != "/v1, Kind=Event" || testMatch("v1/events") != "/v1, Kind=Event" || testMatch("Event") != "/v1, Kind=Event" {
+		t.Fatalf("failed")
+	}
+	if testMatch("events.k8s.io/v1/events") != "events.k8s.io/v1, Kind=Event" || testMatch("*/v1/events") != "/v1, Kind=Event;events.k8s.io/v1, Kind=Event" {
+		t.Fatalf("failed")
+	}
+}
+
+func TestKinds_Wildcards(t *testing.T) {
+	if testMatch("apps/*/deployments") != "apps/v1, Kind=Deployment;apps/v1beta1, Kind=Deployment" {
+		t.Fatalf("failed")
+	}
+	if testMatch("apps/v1/*") != "apps/v1, Kind=Deployment" {
+		t.Fatalf("failed")
+	}
+	if testMatch("*") != "/v1, Kind=Event;/v1, Kind=Node;/v1, Kind=Pod;apps/v1, Kind=Deployment;events.k8s.io/v1, Kind=Event" {
+		t.Fatalf("failed")
+	}
+	if testMatch("*/*/*") != "/v1, Kind=Event;/v1, Kind=Node;/v1, Kind=Pod;apps/v1, Kind=Deployment;apps/v1beta1, Kind=Deployment;events.k8s.io/v1, Kind=Event" {
+		t.Fatalf("failed")
+	}
+}
+
+func TestKinds_Subresources(t *testing.T) {
+	if testMatch("pods/exec") != "/v1, Kind=PodExecOptions" || testMatch("v1/pods/exec") != "/v1, Kind=PodExecOptions" {
+		t.Fatalf("failed")
+	}
+	if testMatch("apps/v1/deployments/scale") != "autoscaling/v1, Kind=Scale" {
+		t.Fatalf("failed")
+	}
+	kinds := matchKinds("pods/status", apiResources(testGroups, testLists))
+	if len(kinds) != 1 || kinds[0].GVK.Kind != "Pod" || kinds[0].Subresource != "status" || kinds[0].Watchable {
+		t.Fatalf("failed")
+	}
+	if testMatch("pods/*") != "/v1, Kind=Pod;/v1, Kind=PodExecOptions" {
+		t.Fatalf("failed")
+	}
+	kinds = matchKinds("pods", apiResources(testGroups, testLists))
+	if len(kinds) != 1 || !kinds[0].Watchable || !kinds[0].Namespaced || kinds[0].GVR.Resource != "pods" {
+		t.Fatalf("failed")
+	}
+}
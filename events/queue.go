@@ -0,0 +1,136 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/logs"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Event is a call to a javascript event function, like jsa_created.
+type Event struct {
+	Name string
+	Run  func() error
+}
+
+// Queue delivers events asynchronously, using a rate-limited workqueue.
+//
+// The workqueue only contains object keys, while events are kept in order in a pending list per key.
+// As the workqueue never processes the same key concurrently, events of an object are delivered in order.
+// Failed events are retried with backoff, and logged as dead-letters after max retries.
+type Queue struct {
+	mux     sync.Mutex
+	cond    *sync.Cond
+	name    string
+	retries int
+	queue   workqueue.RateLimitingInterface
+	pending map[string][]*Event
+}
+
+func NewQueue(name string, workers int, retries int) *Queue {
+	q := &Queue{
+		mux:     sync.Mutex{},
+		name:    name,
+		retries: retries,
+		queue:   workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(100*time.Millisecond, 30*time.Second)),
+		pending: make(map[string][]*Event),
+	}
+	q.cond = sync.NewCond(&q.mux)
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+// Add adds an event for the object key, after all other events of the same key.
+//
+// The key is only queued if it has no pending events, as it is already queued, being processed or backing off after a failure,
+// and its worker delivers all pending events of the key.
+func (q *Queue) Add(key string, event *Event) {
+	if q.queue.ShuttingDown() {
+		return
+	}
+	q.mux.Lock()
+	queued := len(q.pending[key]) > 0
+	q.pending[key] = append(q.pending[key], event)
+	q.mux.Unlock()
+	if !queued {
+		q.queue.Add(key)
+	}
+}
+
+// Idle returns true if there are no pending events.
+func (q *Queue) Idle() bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return len(q.pending) == 0
+}
+
+// Drain waits until all events have been delivered or dropped.
+func (q *Queue) Drain() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for len(q.pending) > 0 && !q.queue.ShuttingDown() {
+		q.cond.Wait()
+	}
+}
+
+// ShutDown stops the workers, dropping all pending events.
+func (q *Queue) ShutDown() {
+	q.queue.ShutDown()
+	q.mux.Lock()
+	q.pending = make(map[string][]*Event)
+	q.cond.Broadcast()
+	q.mux.Unlock()
+}
+
+func (q *Queue) worker() {
+	for q.process() {
+	}
+}
+
+func (q *Queue) process() bool {
+	item, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(item)
+	key := item.(string)
+
+	for {
+		// get next event
+		q.mux.Lock()
+		events := q.pending[key]
+		if len(events) == 0 {
+			delete(q.pending, key)
+			q.cond.Broadcast()
+			q.mux.Unlock()
+			return true
+		}
+		event := events[0]
+		q.mux.Unlock()
+
+		// run event, keeping it first in the list to retry it later
+		err := event.Run()
+		if err != nil {
+			if q.queue.NumRequeues(item) < q.retries {
+				logs.Warnf("Events(%s): %s failed, retrying: %v", q.name, event.Name, err)
+				q.queue.AddRateLimited(item)
+				return true
+			}
+			logs.Errorf("Events(%s): %s failed after %d retries, dropping event: %v", q.name, event.Name, q.retries, err)
+		}
+		q.queue.Forget(item)
+
+		// remove event
+		q.mux.Lock()
+		if len(q.pending[key]) > 0 {
+			q.pending[key] = q.pending[key][1:]
+		}
+		q.mux.Unlock()
+	}
+}
@@ -0,0 +1,99 @@
+package events
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueue_Order(t *testing.T) {
+	q := NewQueue("test", 4, 0)
+	defer q.ShutDown()
+
+	// add events for several keys
+	mux := sync.Mutex{}
+	delivered := make(map[string][]int)
+	for i := 0; i < 100; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			i, key := i, key
+			q.Add(key, &Event{Name: key, Run: func() error {
+				mux.Lock()
+				defer mux.Unlock()
+				delivered[key] = append(delivered[key], i)
+				return nil
+			}})
+		}
+	}
+	q.Drain()
+
+	// check events are delivered in order for each key
+	for _, key := range []string{"a", "b", "c"} {
+		if len(delivered[key]) != 100 {
+			t.Fatalf("failed")
+		}
+		for i, v := range delivered[key] {
+			if i != v {
+				t.Fatalf("failed")
+			}
+		}
+	}
+}
+
+func TestQueue_Retry(t *testing.T) {
+	q := NewQueue("test", 1, 2)
+	defer q.ShutDown()
+
+	// first event fails once, second event always fails
+	calls := make([]string, 0)
+	q.Add("a", &Event{Name: "1", Run: func() error {
+		calls = append(calls, "1")
+		if len(calls) == 1 {
+			return fmt.Errorf("error")
+		}
+		return nil
+	}})
+	q.Add("a", &Event{Name: "2", Run: func() error {
+		calls = append(calls, "2")
+		return fmt.Errorf("error")
+	}})
+	q.Add("a", &Event{Name: "3", Run: func() error {
+		calls = append(calls, "3")
+		return nil
+	}})
+	q.Drain()
+
+	// check first event is retried, second is dropped after 2 retries, third is delivered
+	if fmt.Sprint(calls) != "[1 1 2 2 2 3]" {
+		t.Fatalf("failed: %v", calls)
+	}
+}
+
+func TestQueue_Backoff(t *testing.T) {
+	q := NewQueue("test", 1, 2)
+	defer q.ShutDown()
+
+	// first event fails once and backs off
+	failed := make(chan time.Time, 1)
+	calls := 0
+	q.Add("a", &Event{Name: "1", Run: func() error {
+		calls++
+		if calls == 1 {
+			failed <- time.Now()
+			return fmt.Errorf("error")
+		}
+		return nil
+	}})
+	start := <-failed
+
+	// adding an event while backing off must not bypass the rate limiter
+	var delivered time.Time
+	q.Add("a", &Event{Name: "2", Run: func() error {
+		delivered = time.Now()
+		return nil
+	}})
+	q.Drain()
+	if calls != 2 || delivered.Sub(start) < 90*time.Millisecond {
+		t.Fatalf("failed")
+	}
+}
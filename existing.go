@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/admission"
+	"github.com/momiji/js-admissions-controller/logs"
+	"github.com/momiji/js-admissions-controller/utils"
+	"github.com/momiji/js-admissions-controller/watcher"
+	"github.com/snorwin/jsonpatch"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	// existingCheckPeriod is the interval between checks of leadership and of the next run of spec.mutateExisting
+	existingCheckPeriod = 10 * time.Second
+	// existingMaxResults is the max number of patched or failed objects reported in status
+	existingMaxResults = 50
+)
+
+// existingStatus is the status of the last run of spec.mutateExisting, reported in status.mutateExisting of the admission.
+type existingStatus struct {
+	LastRun time.Time        `json:"lastRun"`
+	DryRun  bool             `json:"dryRun"`
+	Objects int              `json:"objects"`
+	Patched int              `json:"patched"`
+	Failed  int              `json:"failed"`
+	Results []existingResult `json:"results"`
+}
+
+// existingResult is an object patched, or which failed to be patched.
+type existingResult struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	Patch      string `json:"patch,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// mutateExistingAdmission patches cached objects with jsa_mutate when the admission is loaded, then at spec.mutateExisting.interval if set,
+// until the admission code is closed.
+//
+// Objects are only patched on the leader, and are patched again by the next run if they are changed in between.
+func mutateExistingAdmission(code *admission.AdmissionCode, spec *admissionSpec, resources []watcher.Resource) {
+	adm := code.Admission
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-code.Done()
+		cancel()
+	}()
+
+	limiter := flowcontrol.NewTokenBucketRateLimiter(float32(spec.MutateRate), 1)
+	ticker := time.NewTicker(existingCheckPeriod)
+	defer ticker.Stop()
+	next := time.Now()
+	for {
+		if !time.Now().Before(next) && election.IsLeader() {
+			status := mutateExistingObjects(ctx, code, spec.MutateDryRun, resources, limiter)
+			if ctx.Err() != nil {
+				return
+			}
+			logs.Infof("Admissions: mutate existing %s objects=%d patched=%d failed=%d dryRun=%v", adm.FullName(), status.Objects, status.Patched, status.Failed, status.DryRun)
+			if err := writeStatus(ctx, adm, "mutateExisting", status); err != nil {
+				logs.Errorf("Admissions: failed to write status of %s: %v", adm.FullName(), err)
+			}
+			if spec.MutateInterval == 0 {
+				return
+			}
+			next = time.Now().Add(spec.MutateInterval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// existingPatch is the patch of a cached object computed by jsa_mutate, or the error of jsa_mutate.
+type existingPatch struct {
+	resource watcher.Resource
+	obj      *unstructured.Unstructured
+	patch    []byte
+	err      error
+}
+
+// mutateExistingObjects patches all cached objects of resources changed by jsa_mutate, with a dry run patch if dryRun is true.
+//
+// Patches of all objects are computed first, sharing one state read and written once per run, then applied at the rate limit.
+func mutateExistingObjects(ctx context.Context, code *admission.AdmissionCode, dryRun bool, resources []watcher.Resource, limiter flowcontrol.RateLimiter) *existingStatus {
+	adm := code.Admission
+	status := &existingStatus{LastRun: time.Now().UTC(), DryRun: dryRun, Results: make([]existingResult, 0)}
+	options := metav1.PatchOptions{}
+	if dryRun {
+		options.DryRun = []string{metav1.DryRunAll}
+	}
+	objs := make([]existingPatch, 0)
+	for _, resource := range resources {
+		for _, obj := range resourcesWatcher.GetResources(utils.GVKToString(resource.GVK), adm.Namespace) {
+			if adm.Matches(obj) {
+				objs = append(objs, existingPatch{resource: resource, obj: obj})
+			}
+		}
+	}
+	status.Objects = len(objs)
+
+	// compute patches, again if the state has been changed in between
+	var patches []existingPatch
+	err := code.Batch(func(b *admission.AdmissionBatch) error {
+		patches = make([]existingPatch, 0)
+		for _, p := range objs {
+			p.patch, p.err = mutateExistingObject(b, adm, p.obj)
+			if p.err != nil || p.patch != nil {
+				patches = append(patches, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logs.Errorf("Mutate existing: %s - Error: %v", adm.FullName(), err)
+		status.Failed = status.Objects
+		return status
+	}
+
+	// apply patches
+	for _, p := range patches {
+		resource, obj, patch, err := p.resource, p.obj, p.patch, p.err
+		if err == nil {
+			if err = limiter.Wait(ctx); err != nil {
+				return status
+			}
+			client := clusterClient.Resource(resource.GVR).Namespace(obj.GetNamespace())
+			_, err = client.Patch(ctx, obj.GetName(), types.JSONPatchType, patch, options)
+		}
+		result := existingResult{APIVersion: obj.GetAPIVersion(), Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName(), Patch: string(patch)}
+		if err != nil {
+			logs.Errorf("Mutate existing: %s ns=%s name=%s - Error: %v", utils.GVKToString(resource.GVK), obj.GetNamespace(), obj.GetName(), err)
+			result.Error = err.Error()
+			status.Failed++
+		} else {
+			logs.Infof("Mutate existing: %s ns=%s name=%s - Patch: %s dryRun=%v", utils.GVKToString(resource.GVK), obj.GetNamespace(), obj.GetName(), patch, dryRun)
+			status.Patched++
+		}
+		if len(status.Results) < existingMaxResults {
+			status.Results = append(status.Results, result)
+		}
+	}
+	return status
+}
+
+// mutateExistingObject calls jsa_mutate with op BACKGROUND, returning the JSON patch of the object, or nil if it is unchanged.
+//
+// The patch tests the resourceVersion, so it fails if the object has been changed since it has been cached.
+func mutateExistingObject(b *admission.AdmissionBatch, adm *admission.Admission, obj *unstructured.Unstructured) ([]byte, error) {
+	res, err := b.Mutate(admission.OperationBackground, obj.DeepCopy())
+	if err != nil || res == nil {
+		return nil, err
+	}
+	if allowed, found, err := unstructured.NestedBool(res.Object, "Allowed"); found && err == nil && !allowed {
+		return nil, nil
+	}
+	result, _, _ := unstructured.NestedMap(res.Object, "Result")
+	if result == nil {
+		return nil, nil
+	}
+	patch, err := jsonpatch.CreateJSONPatch(result, obj.Object)
+	if err != nil || patch.Empty() {
+		return nil, err
+	}
+
+	// mark object as mutated, like admission requests
+	_ = unstructured.SetNestedField(result, adm.FullName(), "metadata", "annotations", "jsadmissions.momiji.com/mutate")
+	patch, err = jsonpatch.CreateJSONPatch(result, obj.Object)
+	if err != nil {
+		return nil, err
+	}
+	ops := append([]jsonpatch.JSONPatch{{Operation: "test", Path: "/metadata/resourceVersion", Value: obj.GetResourceVersion()}}, patch.List()...)
+	return json.Marshal(ops)
+}
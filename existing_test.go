@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/momiji/js-admissions-controller/admission"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestMutateExistingObject(t *testing.T) {
+	js := `
+	function jsa_mutate(op, obj) {
+		if (op != "BACKGROUND" || obj.metadata.name == "unchanged") return { Allowed: true, Result: obj };
+		obj.spec = { nodeSelector: { pool: "compute" } }
+		return { Allowed: true, Result: obj }
+	}`
+	adm := newLintAdmission([]interface{}{"pods"}, js)
+	codes, err := loadOfflineAdmissions([]*unstructured.Unstructured{adm}, nil, []schema.GroupVersionKind{{Version: "v1", Kind: "Pod"}})
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("Pod")
+	obj.SetName("unchanged")
+	obj.SetResourceVersion("12")
+
+	// unchanged object is not patched, even if jsa_mutate returns it
+	var patch []byte
+	_ = codes[0].Batch(func(b *admission.AdmissionBatch) error {
+		patch, err = mutateExistingObject(b, codes[0].Admission, obj)
+		return nil
+	})
+	if err != nil || patch != nil {
+		t.Fatalf("failed")
+	}
+
+	// changed object is patched and annotated, only if not changed in between
+	obj.SetName("changed")
+	_ = codes[0].Batch(func(b *admission.AdmissionBatch) error {
+		patch, err = mutateExistingObject(b, codes[0].Admission, obj)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	ops := make([]map[string]interface{}, 0)
+	_ = json.Unmarshal(patch, &ops)
+	if len(ops) != 3 || ops[0]["op"] != "test" || ops[0]["value"] != "12" || obj.Object["spec"] != nil {
+		t.Fatalf("failed: %s", patch)
+	}
+}
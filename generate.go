@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/admission"
+	"github.com/momiji/js-admissions-controller/discovery"
+	"github.com/momiji/js-admissions-controller/events"
+	"github.com/momiji/js-admissions-controller/logs"
+	"github.com/momiji/js-admissions-controller/utils"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	GenerateFieldManager = "js-admissions-controller"
+	// GenerateAdmissionLabel is the UID of the admission which generated the object
+	GenerateAdmissionLabel = "jsadmissions.momiji.com/generate"
+	// GenerateTriggerLabel is the UID of the trigger object the object has been generated for
+	GenerateTriggerLabel = "jsadmissions.momiji.com/trigger"
+	GenerateTimeout      = 10 * time.Second
+)
+
+// generateObjects calls jsa_generate for a created or updated trigger object, and applies generated objects with server-side apply.
+//
+// Existing objects are left untouched, unless spec.generate.synchronize is true and they have been generated by this admission.
+func generateObjects(code *admission.AdmissionCode, operation admissionv1.Operation, trigger *unstructured.Unstructured) error {
+	objs, err := code.Generate(operation, trigger)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), GenerateTimeout)
+	defer cancel()
+	for _, obj := range objs {
+		kind, err := prepareGenerated(code.Admission, trigger, obj, discoveryClient)
+		if err != nil {
+			return err
+		}
+		client := clusterClient.Resource(kind.GVR).Namespace(obj.GetNamespace())
+		existing, err := client.Get(ctx, obj.GetName(), metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		if err == nil && !canOverwrite(code.Admission, existing) {
+			if code.Admission.GenerateSync {
+				logs.Warnf("Generate: %s ns=%s name=%s has not been generated by this admission, left untouched", utils.GVKToString(kind.GVK), obj.GetNamespace(), obj.GetName())
+			}
+			continue
+		}
+		_, err = client.Apply(ctx, obj.GetName(), obj, metav1.ApplyOptions{FieldManager: GenerateFieldManager, Force: true})
+		if err != nil {
+			return fmt.Errorf("failed to apply %s ns=%s name=%s: %v", utils.GVKToString(kind.GVK), obj.GetNamespace(), obj.GetName(), err)
+		}
+		logs.Infof("Generate: %s %s ns=%s name=%s", operation, utils.GVKToString(kind.GVK), obj.GetNamespace(), obj.GetName())
+	}
+	return nil
+}
+
+// deleteGenerated deletes all objects generated by the admission for a deleted trigger object, selected by their labels.
+//
+// Objects are listed in all kinds generated by the admission since it has been loaded, and in kinds returned by jsa_generate with op DELETE,
+// so objects of other kinds are only deleted by the garbage collector, when they are owned by the trigger object.
+func deleteGenerated(code *admission.AdmissionCode, trigger *unstructured.Unstructured) error {
+	if trigger.GetUID() == "" {
+		return nil
+	}
+	objs, err := code.Generate(admissionv1.Delete, trigger)
+	if err != nil {
+		logs.Warnf("Generate: %s failed for deleted %s ns=%s name=%s, only known kinds are deleted: %v", admission.JsaGenerate, utils.GVKToString(trigger.GroupVersionKind()), trigger.GetNamespace(), trigger.GetName(), err)
+	}
+	for _, obj := range objs {
+		if _, err := prepareGenerated(code.Admission, trigger, obj, discoveryClient); err != nil {
+			logs.Warnf("Generate: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), GenerateTimeout)
+	defer cancel()
+	selector := fmt.Sprintf("%s=%s,%s=%s", GenerateAdmissionLabel, code.Admission.Owner.UID, GenerateTriggerLabel, trigger.GetUID())
+	for _, kind := range generatedKinds.List(code.Admission.Owner.UID) {
+		// namespace admissions only generate objects in their namespace
+		client := clusterClient.Resource(kind.GVR).Namespace("")
+		if kind.Namespaced {
+			client = clusterClient.Resource(kind.GVR).Namespace(code.Admission.Namespace)
+		}
+		list, err := client.List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return fmt.Errorf("failed to list generated %s: %v", utils.GVKToString(kind.GVK), err)
+		}
+		for _, obj := range list.Items {
+			err = clusterClient.Resource(kind.GVR).Namespace(obj.GetNamespace()).Delete(ctx, obj.GetName(), metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+			logs.Infof("Generate: %s %s ns=%s name=%s", admissionv1.Delete, utils.GVKToString(kind.GVK), obj.GetNamespace(), obj.GetName())
+		}
+	}
+	return nil
+}
+
+// canOverwrite returns true if an existing object can be applied again, only if synchronized and generated by the admission,
+// so objects created by users or other admissions with the same name are never overwritten.
+func canOverwrite(adm *admission.Admission, existing *unstructured.Unstructured) bool {
+	return adm.GenerateSync && existing.GetLabels()[GenerateAdmissionLabel] == string(adm.Owner.UID)
+}
+
+// generateExisting queues generation for all cached trigger objects, with op CREATE, when the admission is loaded,
+// so objects are also generated for trigger objects created before the admission or while it was not running.
+func generateExisting(code *admission.AdmissionCode) error {
+	objs, err := resyncObjects(code.Admission)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		obj := obj
+		key := fmt.Sprintf("%s ns=%s name=%s", utils.GVKToString(obj.GroupVersionKind()), obj.GetNamespace(), obj.GetName())
+		code.Events.Add(key, &events.Event{Name: "generate " + key, Run: func() error { return generateObjects(code, admissionv1.Create, obj) }})
+	}
+	return nil
+}
+
+// prepareGenerated resolves the kind of a generated object, remembered for deletions, and sets its namespace and its labels linking it to the admission and the trigger object.
+//
+// Namespaced objects without namespace are generated in the namespace of the trigger object,
+// and namespace admissions can only generate objects in their namespace.
+func prepareGenerated(adm *admission.Admission, trigger *unstructured.Unstructured, obj *unstructured.Unstructured, kinds *discovery.Discovery) (*discovery.Kind, error) {
+	gvk := obj.GroupVersionKind()
+	if gvk.Kind == "" || gvk.Version == "" || obj.GetName() == "" {
+		return nil, fmt.Errorf("generated object requires apiVersion, kind and metadata.name, got %v", obj.Object)
+	}
+	kind, err := resolveGeneratedKind(kinds, gvk)
+	if err != nil {
+		return nil, err
+	}
+
+	// set namespace
+	if kind.Namespaced {
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(trigger.GetNamespace())
+		}
+		if obj.GetNamespace() == "" {
+			return nil, fmt.Errorf("generated %s %s requires metadata.namespace", utils.GVKToString(gvk), obj.GetName())
+		}
+		if adm.Namespace != "" && obj.GetNamespace() != adm.Namespace {
+			return nil, fmt.Errorf("generated %s ns=%s name=%s is not in admission namespace", utils.GVKToString(gvk), obj.GetNamespace(), obj.GetName())
+		}
+	} else {
+		if adm.Namespace != "" {
+			return nil, fmt.Errorf("generated %s name=%s is a cluster object, not allowed for namespace admissions", utils.GVKToString(gvk), obj.GetName())
+		}
+		obj.SetNamespace("")
+	}
+
+	// link to admission and trigger
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[GenerateAdmissionLabel] = string(adm.Owner.UID)
+	labels[GenerateTriggerLabel] = string(trigger.GetUID())
+	obj.SetLabels(labels)
+	generatedKinds.Add(adm.Owner.UID, *kind)
+
+	// owned by trigger, so it is also garbage collected if the delete of the trigger is missed
+	if adm.GenerateDelete && trigger.GetUID() != "" && (trigger.GetNamespace() == "" || trigger.GetNamespace() == obj.GetNamespace()) {
+		obj.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: trigger.GetAPIVersion(), Kind: trigger.GetKind(), Name: trigger.GetName(), UID: trigger.GetUID()}})
+	}
+	return kind, nil
+}
+
+// resolveGeneratedKind returns the resource of a generated object kind.
+func resolveGeneratedKind(kinds *discovery.Discovery, gvk schema.GroupVersionKind) (*discovery.Kind, error) {
+	group := gvk.Group
+	if group == "" {
+		group = "core"
+	}
+	resolved, err := kinds.ResolveKinds(fmt.Sprintf("%s/%s/%s", group, gvk.Version, gvk.Kind))
+	if err != nil {
+		return nil, err
+	}
+	for _, kind := range resolved {
+		if kind.Subresource == "" {
+			return &kind, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to find resource %s", utils.GVKToString(gvk))
+}
+
+// kindsRegistry remembers the kinds of objects generated by each admission, by admission UID,
+// so objects generated for a deleted trigger object can be listed by their labels.
+type kindsRegistry struct {
+	mux   sync.Mutex
+	kinds map[types.UID]map[schema.GroupVersionResource]discovery.Kind
+}
+
+var generatedKinds = &kindsRegistry{kinds: make(map[types.UID]map[schema.GroupVersionResource]discovery.Kind)}
+
+func (r *kindsRegistry) Add(uid types.UID, kind discovery.Kind) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.kinds[uid] == nil {
+		r.kinds[uid] = make(map[schema.GroupVersionResource]discovery.Kind)
+	}
+	r.kinds[uid][kind.GVR] = kind
+}
+
+// List returns the kinds generated by the admission, sorted so objects are always deleted in the same order.
+func (r *kindsRegistry) List(uid types.UID) []discovery.Kind {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	kinds := make([]discovery.Kind, 0, len(r.kinds[uid]))
+	for _, kind := range r.kinds[uid] {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i].GVR.String() < kinds[j].GVR.String() })
+	return kinds
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/admission"
+	"github.com/momiji/js-admissions-controller/discovery"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func newGenerated(apiVersion string, kind string, namespace string, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+func TestPrepareGenerated(t *testing.T) {
+	kinds := discovery.NewStaticDiscovery([]schema.GroupVersionKind{
+		{Version: "v1", Kind: "ConfigMap"},
+		{Group: "networking.k8s.io", Version: "v1", Kind: "NetworkPolicy"},
+	})
+	adm := &admission.Admission{Name: "adm", Owner: metav1.OwnerReference{UID: "adm-uid"}, GenerateDelete: true}
+	trigger := newGenerated("v1", "Pod", "ns", "pod")
+	trigger.SetUID("pod-uid")
+
+	// namespace of trigger is used by default, and object is linked to admission and trigger
+	obj := newGenerated("networking.k8s.io/v1", "NetworkPolicy", "", "deny")
+	kind, err := prepareGenerated(adm, trigger, obj, kinds)
+	if err != nil || kind.GVR.Resource != "networkpolicies" || obj.GetNamespace() != "ns" {
+		t.Fatalf("failed: %v", err)
+	}
+	if obj.GetLabels()[GenerateAdmissionLabel] != "adm-uid" || obj.GetLabels()[GenerateTriggerLabel] != "pod-uid" || len(obj.GetOwnerReferences()) != 1 {
+		t.Fatalf("failed")
+	}
+
+	// not owned by a trigger in another namespace
+	obj = newGenerated("v1", "ConfigMap", "other", "cm")
+	if _, err = prepareGenerated(adm, trigger, obj, kinds); err != nil || len(obj.GetOwnerReferences()) != 0 {
+		t.Fatalf("failed")
+	}
+
+	// namespace admissions only generate objects in their namespace
+	adm.Namespace = "ns"
+	if _, err = prepareGenerated(adm, trigger, newGenerated("v1", "ConfigMap", "other", "cm"), kinds); err == nil {
+		t.Fatalf("failed")
+	}
+
+	// unknown kinds and objects without name are rejected
+	if _, err = prepareGenerated(adm, trigger, newGenerated("v1", "Secret", "ns", "s"), kinds); err == nil {
+		t.Fatalf("failed")
+	}
+	if _, err = prepareGenerated(adm, trigger, newGenerated("v1", "ConfigMap", "ns", ""), kinds); err == nil {
+		t.Fatalf("failed")
+	}
+}
+
+func TestCanOverwrite(t *testing.T) {
+	adm := &admission.Admission{Name: "adm", Owner: metav1.OwnerReference{UID: "adm-uid"}}
+	existing := newGenerated("v1", "ConfigMap", "ns", "cm")
+
+	// objects are never overwritten without synchronize
+	existing.SetLabels(map[string]string{GenerateAdmissionLabel: "adm-uid"})
+	if canOverwrite(adm, existing) {
+		t.Fatalf("failed")
+	}
+
+	// only objects generated by the admission are synchronized
+	adm.GenerateSync = true
+	if !canOverwrite(adm, existing) {
+		t.Fatalf("failed")
+	}
+	existing.SetLabels(map[string]string{GenerateAdmissionLabel: "other-uid"})
+	if canOverwrite(adm, existing) {
+		t.Fatalf("failed")
+	}
+	existing.SetLabels(nil)
+	if canOverwrite(adm, existing) {
+		t.Fatalf("failed")
+	}
+}
+
+func TestDeleteGenerated(t *testing.T) {
+	cm := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	np := schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}
+	discoveryClient = discovery.NewStaticDiscovery([]schema.GroupVersionKind{
+		{Version: "v1", Kind: "ConfigMap"},
+		{Group: "networking.k8s.io", Version: "v1", Kind: "NetworkPolicy"},
+	})
+	generated := func(apiVersion string, kind string, name string, trigger string) *unstructured.Unstructured {
+		obj := newGenerated(apiVersion, kind, "ns", name)
+		obj.SetLabels(map[string]string{GenerateAdmissionLabel: "delete-uid", GenerateTriggerLabel: trigger})
+		return obj
+	}
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		cm: "ConfigMapList",
+		np: "NetworkPolicyList",
+	},
+		generated("v1", "ConfigMap", "renamed", "pod-uid"),
+		generated("v1", "ConfigMap", "other", "other-uid"),
+		newGenerated("v1", "ConfigMap", "ns", "user"),
+		generated("networking.k8s.io/v1", "NetworkPolicy", "deny", "pod-uid"),
+	)
+	clusterClient = client
+
+	// jsa_generate returns nothing on delete
+	code, err := admission.NewAdmissions().Upsert(&admission.Admission{
+		Namespace:      "ns",
+		Name:           "adm",
+		Resources:      []string{"v1/Pod"},
+		Javascript:     `function jsa_generate(obj, op) { if (op != "DELETE") return [{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "cm" } }] }`,
+		Timeout:        time.Second,
+		Owner:          metav1.OwnerReference{UID: "delete-uid"},
+		GenerateDelete: true,
+	})
+	if err != nil {
+		t.Fatalf("failed")
+	}
+	_ = code.Init(false)
+	trigger := newGenerated("v1", "Pod", "ns", "pod")
+	trigger.SetUID("pod-uid")
+
+	// config maps have been generated, but not network policies
+	if _, err = prepareGenerated(code.Admission, trigger, newGenerated("v1", "ConfigMap", "", "cm"), discoveryClient); err != nil {
+		t.Fatalf("failed")
+	}
+
+	// objects of generated kinds are selected by labels, even if not returned by jsa_generate
+	if err = deleteGenerated(code, trigger); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	list, _ := client.Resource(cm).Namespace("ns").List(context.Background(), metav1.ListOptions{})
+	names := make([]string, 0)
+	for _, obj := range list.Items {
+		names = append(names, obj.GetName())
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "other,user" {
+		t.Fatalf("failed: %v", names)
+	}
+
+	// objects of other kinds are left to the garbage collector
+	if _, err = client.Resource(np).Namespace("ns").Get(context.Background(), "deny", metav1.GetOptions{}); err != nil {
+		t.Fatalf("failed")
+	}
+}
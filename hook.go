@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/momiji/js-admissions-controller/logs"
 	"github.com/momiji/js-admissions-controller/utils"
@@ -23,10 +24,41 @@ func serveValidate(w http.ResponseWriter, r *http.Request) {
 	serve(w, r, validate)
 }
 
-type admitv1Func func(*admission.AdmissionReview) *admission.AdmissionResponse
+const (
+	// hookTimeout is the timeout of admission requests when the API server does not send it, the default of timeoutSeconds
+	hookTimeout = 10 * time.Second
+	// hookDeadlineRatio is the ratio of the request timeout given to admissions, keeping time to send the response
+	hookDeadlineRatio = 0.9
+)
+
+// admitv1Func calls admissions for a request, which must be answered before deadline if it is not the zero time.
+type admitv1Func func(ar *admission.AdmissionReview, deadline time.Time) *admission.AdmissionResponse
+
+// requestDeadline returns the deadline of an admission request, from the timeout query parameter sent by the API server.
+func requestDeadline(r *http.Request, start time.Time) time.Time {
+	timeout, err := time.ParseDuration(r.URL.Query().Get("timeout"))
+	if err != nil || timeout <= 0 {
+		timeout = hookTimeout
+	}
+	return start.Add(time.Duration(float64(timeout) * hookDeadlineRatio))
+}
+
+// deadlineResponse is the response of a request cut off at its deadline, before calling the admission.
+func deadlineResponse(adm string) *admission.AdmissionResponse {
+	return &admission.AdmissionResponse{
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusGatewayTimeout,
+			Reason:  metav1.StatusReasonTimeout,
+			Message: fmt.Sprintf("deadline exceeded before admission %s", adm),
+		},
+	}
+}
 
 // serve handles the http portion of a request prior to handing to an admit function
 func serve(w http.ResponseWriter, r *http.Request, admit admitv1Func) {
+	deadline := requestDeadline(r, time.Now())
+
 	// verify the content type is accurate
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
@@ -61,10 +93,17 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitv1Func) {
 	// call admission mutate/validate func
 	responseAdmissionReview := &admission.AdmissionReview{}
 	responseAdmissionReview.SetGroupVersionKind(*gvk)
-	responseAdmissionReview.Response = admit(requestedAdmissionReview)
+	responseAdmissionReview.Response = admit(requestedAdmissionReview, deadline)
 	responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
 	responseObj = responseAdmissionReview
 
+	// record request and response, to replay them later, written in background
+	if admissionRecorder != nil {
+		if err = admissionRecorder.Record(r.URL.Path, requestedAdmissionReview.Request, responseAdmissionReview.Response); err != nil {
+			logs.Errorf("Unable to record admission request: %v", err)
+		}
+	}
+
 	// send response
 	//logs.Infof("sending response: %v", responseObj)
 	respBytes, err := json.Marshal(responseObj)
@@ -79,11 +118,17 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitv1Func) {
 	}
 }
 
-func mutate(ar *admission.AdmissionReview) *admission.AdmissionResponse {
+func mutate(ar *admission.AdmissionReview, deadline time.Time) *admission.AdmissionResponse {
+	response, _ := mutateObject(ar, deadline)
+	return response
+}
+
+// mutateObject calls all admissions mutate, returning the response and the mutated object, or nil if unchanged.
+func mutateObject(ar *admission.AdmissionReview, deadline time.Time) (*admission.AdmissionResponse, *unstructured.Unstructured) {
 	// skip if no admissions
-	adms := admissions.Find(utils.GVK1ToString(ar.Request.Kind), ar.Request.Namespace)
+	adms := admissions.Find(utils.ResourceKey(utils.GVK1ToString(ar.Request.Kind), ar.Request.SubResource), ar.Request.Namespace)
 	if len(adms) == 0 {
-		return &admission.AdmissionResponse{Allowed: true}
+		return &admission.AdmissionResponse{Allowed: true}, nil
 	}
 
 	// log
@@ -105,7 +150,7 @@ func mutate(ar *admission.AdmissionReview) *admission.AdmissionResponse {
 	if obj != nil && !ok {
 		showLog(true, "Error")
 		logs.Errorf("Mutate failed, item is not *unstructured.Unstructured: %s", ar.Request.Object.Raw)
-		return &admission.AdmissionResponse{Allowed: true}
+		return &admission.AdmissionResponse{Allowed: true}, nil
 	}
 	newUObj := &unstructured.Unstructured{Object: uObj.Object}
 	changed := false
@@ -116,7 +161,11 @@ func mutate(ar *admission.AdmissionReview) *admission.AdmissionResponse {
 	}
 
 	for _, code := range adms {
-		res, err := code.Mutate(ar.Request.Operation, newUObj.DeepCopy())
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			showLog(true, "Deadline exceeded")
+			return deadlineResponse(code.Admission.FullName()), nil
+		}
+		res, err := code.Mutate(ar.Request.Operation, newUObj.DeepCopy(), deadline)
 		if err != nil {
 			showLog(true, "Error")
 			logs.Errorf("Error in mutate: %v", err)
@@ -124,7 +173,7 @@ func mutate(ar *admission.AdmissionReview) *admission.AdmissionResponse {
 				Result: &metav1.Status{
 					Message: err.Error(),
 				},
-			}
+			}, nil
 		}
 		if res != nil {
 			allowed, b, e := unstructured.NestedBool(res.Object, "Allowed")
@@ -135,7 +184,7 @@ func mutate(ar *admission.AdmissionReview) *admission.AdmissionResponse {
 					Result: &metav1.Status{
 						Message: message,
 					},
-				}
+				}, nil
 			}
 			result, _, _ := unstructured.NestedMap(res.Object, "Result")
 			if result != nil {
@@ -154,21 +203,21 @@ func mutate(ar *admission.AdmissionReview) *admission.AdmissionResponse {
 				Result: &metav1.Status{
 					Message: err.Error(),
 				},
-			}
+			}, nil
 		}
 		// success
 		showLog(true, fmt.Sprintf("Patch: %s", patch))
 		patchType := admission.PatchTypeJSONPatch
-		return &admission.AdmissionResponse{Allowed: true, PatchType: &patchType, Patch: patch.Raw()}
+		return &admission.AdmissionResponse{Allowed: true, PatchType: &patchType, Patch: patch.Raw()}, newUObj
 	}
 
 	// success
-	return &admission.AdmissionResponse{Allowed: true}
+	return &admission.AdmissionResponse{Allowed: true}, nil
 }
 
-func validate(ar *admission.AdmissionReview) *admission.AdmissionResponse {
+func validate(ar *admission.AdmissionReview, deadline time.Time) *admission.AdmissionResponse {
 	// skip if no admissions
-	adms := admissions.Find(utils.GVK1ToString(ar.Request.Kind), ar.Request.Namespace)
+	adms := admissions.Find(utils.ResourceKey(utils.GVK1ToString(ar.Request.Kind), ar.Request.SubResource), ar.Request.Namespace)
 	if len(adms) == 0 {
 		return &admission.AdmissionResponse{Allowed: true}
 	}
@@ -196,7 +245,11 @@ func validate(ar *admission.AdmissionReview) *admission.AdmissionResponse {
 	}
 
 	for _, code := range adms {
-		res, err := code.Validate(ar.Request.Operation, uObj)
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			showLog(true, "Deadline exceeded")
+			return deadlineResponse(code.Admission.FullName())
+		}
+		res, err := code.Validate(ar.Request.Operation, uObj, deadline)
 		if err != nil {
 			showLog(true, "Error")
 			logs.Errorf("Error in validate: %v", err)
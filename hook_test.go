@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jsadmission "github.com/momiji/js-admissions-controller/admission"
+	admission "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestRequestDeadline(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// timeout sent by the API server
+	deadline := requestDeadline(httptest.NewRequest("POST", "/validate?timeout=5s", nil), start)
+	if !deadline.Equal(start.Add(4500 * time.Millisecond)) {
+		t.Fatalf("failed")
+	}
+
+	// default timeout, also for invalid timeouts
+	for _, target := range []string{"/validate", "/validate?timeout=abc", "/validate?timeout=0s", "/validate?timeout=-1s"} {
+		deadline = requestDeadline(httptest.NewRequest("POST", target, nil), start)
+		if !deadline.Equal(start.Add(9 * time.Second)) {
+			t.Fatalf("failed %s", target)
+		}
+	}
+}
+
+func TestServeDeadline(t *testing.T) {
+	review := `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"1","operation":"CREATE"}}`
+
+	// admissions receive the deadline of the timeout sent by the API server
+	var deadline time.Time
+	admit := func(ar *admission.AdmissionReview, d time.Time) *admission.AdmissionResponse {
+		deadline = d
+		return deadlineResponse("ns/adm")
+	}
+	r := httptest.NewRequest("POST", "/validate?timeout=2s", strings.NewReader(review))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	serve(w, r, admit)
+	if deadline.Before(start.Add(1800*time.Millisecond)) || deadline.After(time.Now().Add(1800*time.Millisecond)) {
+		t.Fatalf("failed")
+	}
+
+	// requests cut off at their deadline are denied with a timeout status
+	response := &admission.AdmissionReview{}
+	if err := json.Unmarshal(w.Body.Bytes(), response); err != nil || response.Response == nil {
+		t.Fatalf("failed")
+	}
+	result := response.Response.Result
+	if response.Response.Allowed || response.Response.UID != "1" || result.Code != http.StatusGatewayTimeout || result.Reason != metav1.StatusReasonTimeout {
+		t.Fatalf("failed")
+	}
+}
+
+func TestValidateSubresource(t *testing.T) {
+	admissions = jsadmission.NewAdmissions()
+	code, err := admissions.Upsert(&jsadmission.Admission{
+		Namespace:  "ns",
+		Name:       "status",
+		Resources:  []string{"v1/Pod/status"},
+		Javascript: `function jsa_validate(op, obj) { return { Allowed: false, Message: "denied" } }`,
+		Timeout:    time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed")
+	}
+	_ = code.Init(false)
+	admissions.Activate(code)
+
+	request := func(operation admission.Operation, subresource string) *admission.AdmissionReview {
+		return &admission.AdmissionReview{Request: &admission.AdmissionRequest{
+			Kind:        metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace:   "ns",
+			Name:        "pod",
+			Operation:   operation,
+			SubResource: subresource,
+			Object:      runtime.RawExtension{Raw: []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"pod","namespace":"ns"}}`)},
+		}}
+	}
+
+	// admissions of a subresource are not called for its parent resource
+	if response := validate(request(admission.Create, ""), time.Time{}); !response.Allowed {
+		t.Fatalf("failed")
+	}
+	if response := validate(request(admission.Update, ""), time.Time{}); !response.Allowed {
+		t.Fatalf("failed")
+	}
+
+	// but are called for the subresource
+	if response := validate(request(admission.Update, "status"), time.Time{}); response.Allowed {
+		t.Fatalf("failed")
+	}
+}
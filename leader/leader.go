@@ -0,0 +1,82 @@
+package leader
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/logs"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Election tells if the current replica is the leader, using a Lease.
+//
+// When leader election is not enabled, the current replica is always the leader.
+type Election struct {
+	enabled bool
+	leading atomic.Bool
+}
+
+func NewElection(enabled bool) *Election {
+	return &Election{enabled: enabled}
+}
+
+func (e *Election) IsLeader() bool {
+	return !e.enabled || e.leading.Load()
+}
+
+// Run starts leader election until ctx is done, calling onStarted each time the replica becomes the leader.
+func (e *Election) Run(ctx context.Context, config *rest.Config, namespace string, name string, identity string, onStarted func()) error {
+	client, err := coordinationv1.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+		Client: client,
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				logs.Infof("Leader: started leading %s/%s as %s", namespace, name, identity)
+				e.leading.Store(true)
+				if onStarted != nil {
+					onStarted()
+				}
+			},
+			OnStoppedLeading: func() {
+				logs.Infof("Leader: stopped leading %s/%s as %s", namespace, name, identity)
+				e.leading.Store(false)
+			},
+			OnNewLeader: func(current string) {
+				logs.Infof("Leader: current leader is %s", current)
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// run again after losing leadership, until ctx is done
+	go func() {
+		for ctx.Err() == nil {
+			elector.Run(ctx)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/admission"
+	"github.com/momiji/js-admissions-controller/discovery"
+	"github.com/momiji/js-admissions-controller/logs"
+	"github.com/momiji/js-admissions-controller/utils"
+	"github.com/spf13/pflag"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// lintAdmission checks the spec and the javascript code of an admission, returning errors and warnings.
+//
+// Kinds are resolved with discovery if not nil, unknown kinds being warnings as they may be installed later.
+func lintAdmission(obj *unstructured.Unstructured, kinds *discovery.Discovery) ([]string, []string) {
+	errors := make([]string, 0)
+	warnings := make([]string, 0)
+	if obj.GroupVersionKind().Group != GroupCrd || (obj.GetKind() != NamespaceKind && obj.GetKind() != ClusterKind) {
+		return append(errors, fmt.Sprintf("unknown kind %s", obj.GroupVersionKind())), warnings
+	}
+
+	spec, err := parseAdmissionSpec(obj)
+	if err != nil {
+		return append(errors, err.Error()), warnings
+	}
+	if len(spec.Kinds) == 0 {
+		errors = append(errors, "spec.kinds is empty")
+	}
+	if spec.Js == "" {
+		errors = append(errors, "spec.js is empty")
+	}
+	required := make([]string, 0)
+	for _, index := range spec.Indexes {
+		if index.Function != "" {
+			required = append(required, index.Function)
+		}
+	}
+	for _, schedule := range spec.Schedules {
+		required = append(required, schedule.Function)
+	}
+	errors = append(errors, admission.Lint(spec.Js, required...)...)
+
+	if kinds != nil {
+		for _, kind := range spec.Kinds {
+			if _, err := kinds.ResolveKinds(kind); err != nil {
+				warnings = append(warnings, fmt.Sprintf("kind %s not found, admission is not loaded until it is installed: %v", kind, err))
+			}
+		}
+	}
+	return errors, warnings
+}
+
+// lintCommand lints admissions files, returning the exit code.
+func lintCommand(args []string) int {
+	flags := pflag.NewFlagSet("lint", pflag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s lint [flags] admissions.yaml...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	useDiscovery := flags.Bool("discovery", false, "Resolve kinds with the discovery of the cluster from KUBECONFIG")
+	staticKinds := flags.StringSlice("kinds", nil, "Resolve kinds against this list of kinds, like v1/Pod,apps/v1/Deployment")
+	strict := flags.Bool("strict", false, "Fail on warnings, like kinds not found")
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	// create discovery, to resolve kinds
+	var kinds *discovery.Discovery
+	if len(*staticKinds) > 0 {
+		gvks := make([]schema.GroupVersionKind, 0)
+		for _, kind := range *staticKinds {
+			gvk, err := parseStaticKind(kind)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid kind %s: %v\n", kind, err)
+				return 2
+			}
+			gvks = append(gvks, gvk)
+		}
+		kinds = discovery.NewStaticDiscovery(gvks)
+	} else if *useDiscovery {
+		config, err := clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+		if err == nil {
+			kinds, err = discovery.NewDiscovery(config)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create discovery client: %v\n", err)
+			return 2
+		}
+	}
+
+	failed := false
+	for _, file := range flags.Args() {
+		objs, err := readObjects(file)
+		if err != nil {
+			fmt.Printf("%s: %v\n", file, err)
+			failed = true
+			continue
+		}
+		for _, obj := range objs {
+			name := fmt.Sprintf("%s %s", obj.GetKind(), obj.GetName())
+			if obj.GetNamespace() != "" {
+				name = fmt.Sprintf("%s %s/%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+			}
+			errors, warnings := lintAdmission(obj, kinds)
+			for _, e := range errors {
+				fmt.Printf("%s: %s: error: %s\n", file, name, e)
+			}
+			for _, w := range warnings {
+				fmt.Printf("%s: %s: warning: %s\n", file, name, w)
+			}
+			failed = failed || len(errors) > 0 || (*strict && len(warnings) > 0)
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// parseStaticKind parses a kind like v1/Pod or apps/v1/Deployment.
+func parseStaticKind(kind string) (schema.GroupVersionKind, error) {
+	parts := strings.Split(kind, "/")
+	switch len(parts) {
+	case 2:
+		return schema.GroupVersionKind{Version: parts[0], Kind: parts[1]}, nil
+	case 3:
+		return schema.GroupVersionKind{Group: parts[0], Version: parts[1], Kind: parts[2]}, nil
+	}
+	return schema.GroupVersionKind{}, fmt.Errorf("expected version/Kind or group/version/Kind")
+}
+
+func serveValidateAdmission(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, validateAdmission)
+}
+
+// validateAdmission rejects invalid JsAdmission and ClusterJsAdmission objects, with the same checks as the lint command.
+func validateAdmission(ar *admissionv1.AdmissionReview, _ time.Time) *admissionv1.AdmissionResponse {
+	if ar.Request.Operation == admissionv1.Delete {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(ar.Request.Object.Raw); err != nil {
+		logs.Errorf("Validate admission failed, unable to decode object: %v", err)
+		return &admissionv1.AdmissionResponse{Result: &metav1.Status{Message: err.Error()}}
+	}
+	errors, warnings := lintAdmission(obj, discoveryClient)
+	if len(errors) > 0 {
+		logs.Infof("Validate admission: %s %s ns=%s name=%s - Forbidden: %s", ar.Request.Operation, utils.GVK1ToString(ar.Request.Kind), ar.Request.Namespace, ar.Request.Name, strings.Join(errors, "; "))
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: "invalid admission: " + strings.Join(errors, "; "),
+			},
+			Warnings: warnings,
+		}
+	}
+	return &admissionv1.AdmissionResponse{Allowed: true, Warnings: warnings}
+}
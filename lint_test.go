@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/discovery"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func newLintAdmission(kinds []interface{}, js string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "momiji.com/v1",
+		"kind":       "ClusterJsAdmissions",
+		"metadata":   map[string]interface{}{"name": "test"},
+		"spec":       map[string]interface{}{"kinds": kinds, "js": js},
+	}}
+}
+
+func TestLintAdmission(t *testing.T) {
+	kinds := discovery.NewStaticDiscovery([]schema.GroupVersionKind{{Version: "v1", Kind: "Pod"}})
+
+	// valid admission
+	errors, warnings := lintAdmission(newLintAdmission([]interface{}{"pods"}, "function jsa_validate(op, obj) {}"), kinds)
+	if len(errors) != 0 || len(warnings) != 0 {
+		t.Fatalf("failed")
+	}
+
+	// unknown kinds are only warnings
+	errors, warnings = lintAdmission(newLintAdmission([]interface{}{"deployments"}, "function jsa_validate(op, obj) {}"), kinds)
+	if len(errors) != 0 || len(warnings) != 1 {
+		t.Fatalf("failed")
+	}
+
+	// invalid code and spec
+	errors, _ = lintAdmission(newLintAdmission([]interface{}{}, "function jsa_validate(op, obj) {"), nil)
+	if len(errors) != 2 || errors[0] != "spec.kinds is empty" {
+		t.Fatalf("failed %v", errors)
+	}
+
+	// lint files
+	if lintCommand([]string{"--kinds", "v1/Pod", "tests/suite/admissions.yaml"}) != 0 {
+		t.Fatalf("failed")
+	}
+	if lintCommand([]string{"--kinds", "apps/v1/Deployment", "--strict", "tests/suite/admissions.yaml"}) != 1 {
+		t.Fatalf("failed")
+	}
+}
+
+func TestValidateAdmission(t *testing.T) {
+	raw, _ := json.Marshal(newLintAdmission([]interface{}{"pods"}, "function jsa_helper() {}").Object)
+	response := validateAdmission(&admissionv1.AdmissionReview{Request: &admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}}, time.Time{})
+	if response.Allowed || !strings.HasPrefix(response.Result.Message, "invalid admission: jsa_helper: unknown function") {
+		t.Fatalf("failed")
+	}
+}
@@ -9,19 +9,31 @@ import (
 	"os/signal"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/momiji/js-admissions-controller/admission"
 	"github.com/momiji/js-admissions-controller/discovery"
+	"github.com/momiji/js-admissions-controller/events"
+	"github.com/momiji/js-admissions-controller/leader"
 	"github.com/momiji/js-admissions-controller/logs"
+	"github.com/momiji/js-admissions-controller/metrics"
+	"github.com/momiji/js-admissions-controller/recorder"
+	"github.com/momiji/js-admissions-controller/report"
+	"github.com/momiji/js-admissions-controller/state"
 	"github.com/momiji/js-admissions-controller/utils"
 	"github.com/momiji/js-admissions-controller/watcher"
 	"github.com/spf13/pflag"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/workqueue"
 )
 
 const (
@@ -30,27 +42,71 @@ const (
 
 	ClusterCrd   = GroupCrd + "/" + VersionCrd + "/clusterjsadmissions"
 	NamespaceCrd = GroupCrd + "/" + VersionCrd + "/jsadmissions"
+
+	ClusterKind   = "ClusterJsAdmissions"
+	NamespaceKind = "JsAdmissions"
+
+	CustomResourceDefinitions = "apiextensions.k8s.io/v1/customresourcedefinitions"
+
+	// DefaultTimeout is the default execution timeout in seconds for javascript code
+	DefaultTimeout = int(admission.DefaultTimeout / time.Second)
 )
 
 var (
 	clusterConfig     *rest.Config
-	clusterClient     *dynamic.DynamicClient
+	clusterClient     dynamic.Interface
+	metadataClient    metadata.Interface
 	discoveryClient   *discovery.Discovery
 	admissions        *admission.Admissions
 	resourcesWatcher  *watcher.Watcher
 	admissionsWatcher *watcher.Watcher
+	crdsWatcher       *watcher.Watcher
+	crdsSynced        atomic.Bool
+	watchSequence     atomic.Int64
+	statePersister    *state.Persister
+	reportWriter      *report.Writer
+	election          *leader.Election
+	admissionKinds    []string
 	timeout           int
+	jsLimits          = admission.DefaultLimits
+	namespace         string
+	stateInterval     int
+	stateMaxSize      int
+	leaderElection    bool
+	eventWorkers      int
+	eventRetries      int
+	resyncPeriod      int
+	leaderName        string
+	admissionRecorder *recorder.Recorder
 	Version           = "dev"
 )
 
+// commands are subcommands of the binary, running without cluster and returning the exit code.
+var commands = map[string]func(args []string) int{
+	"test":   testCommand,
+	"lint":   lintCommand,
+	"replay": replayCommand,
+}
+
 func main() {
 	var err error
 
+	// run subcommand
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
 	// vars
 	var tlsKey, tlsCert string
 	var showVersion, showHelp bool
 	var ip net.IP
 	var port int
+	var recordFile string
+	var recordSampling float64
+	var recordMaxSize int64
+	var recordMaxFiles int
 
 	// flags
 	pflag.IPVar(&ip, "ip", net.ParseIP("0.0.0.0"), "Bind address IP")
@@ -61,7 +117,22 @@ func main() {
 	pflag.BoolVarP(&showHelp, "help", "h", false, "Show help")
 	pflag.BoolVarP(&logs.DebugMode, "verbose", "v", false, "Verbose mode (with javascript logs)")
 	pflag.BoolVarP(&logs.TraceMode, "debug", "d", false, "Debug mode (all logs))")
-	pflag.IntVar(&timeout, "timeout", 10, "Execution timeout for javascript code")
+	pflag.IntVar(&timeout, "timeout", DefaultTimeout, "Execution timeout in seconds for javascript code, unless set by spec.timeout")
+	pflag.IntVar(&jsLimits.MaxCallStackSize, "maxCallStackSize", admission.DefaultLimits.MaxCallStackSize, "Max depth of nested javascript calls, 0 for no limit")
+	pflag.IntVar(&jsLimits.MaxArrayLength, "maxArrayLength", admission.DefaultLimits.MaxArrayLength, "Max length of javascript arrays created by builtins, returned or stored in state, 0 for no limit")
+	pflag.IntVar(&jsLimits.MaxStringLength, "maxStringLength", admission.DefaultLimits.MaxStringLength, "Max length in bytes of javascript strings created by builtins, returned or stored in state, 0 for no limit")
+	pflag.StringVar(&namespace, "namespace", utils.CurrentNamespace("kube-jsadmissions"), "Namespace of the controller, used to store objects of cluster admissions")
+	pflag.IntVar(&stateInterval, "stateInterval", 60, "Interval in seconds between snapshots of persisted states, 0 to only save them on shutdown")
+	pflag.IntVar(&stateMaxSize, "stateMaxSize", 512*1024, "Max size in bytes of a persisted state")
+	pflag.BoolVar(&leaderElection, "leaderElection", false, "Enable leader election, so events of admissions with spec.events.leaderOnly only run on the leader")
+	pflag.StringVar(&leaderName, "leaderName", "jsadmissions", "Name of the Lease used for leader election")
+	pflag.IntVar(&eventWorkers, "eventWorkers", 2, "Number of workers per admission delivering events to jsa_created/updated/deleted")
+	pflag.IntVar(&eventRetries, "eventRetries", 5, "Number of retries of a failed event before dropping it")
+	pflag.IntVar(&resyncPeriod, "resyncPeriod", 60, "Interval in seconds between resyncs of informers, 0 to disable")
+	pflag.StringVar(&recordFile, "recordFile", "", "File recording admission requests and responses, to replay them with the replay command, empty to disable")
+	pflag.Float64Var(&recordSampling, "recordSampling", 1, "Ratio of recorded admission requests, between 0 and 1")
+	pflag.Int64Var(&recordMaxSize, "recordMaxSize", 10*1024*1024, "Max size in bytes of the record file before rotation")
+	pflag.IntVar(&recordMaxFiles, "recordMaxFiles", 3, "Number of rotated record files to keep")
 
 	// env
 	re := regexp.MustCompile("_[a-z]")
@@ -110,6 +181,10 @@ func main() {
 	if err != nil {
 		logs.Fatalf("Unable to create kube client: %v", err)
 	}
+	metadataClient, err = metadata.NewForConfig(clusterConfig)
+	if err != nil {
+		logs.Fatalf("Unable to create kube metadata client: %v", err)
+	}
 
 	// create discovery
 	discoveryClient, err = discovery.NewDiscovery(clusterConfig)
@@ -120,6 +195,15 @@ func main() {
 	// create admissions
 	admissions = admission.NewAdmissions()
 
+	// create state persister
+	statePersister = state.NewPersister(clusterClient, namespace, stateMaxSize)
+
+	// create policy reports writer
+	reportWriter = report.NewWriter(clusterClient)
+
+	// create leader election, not leader until elected
+	election = leader.NewElection(leaderElection)
+
 	// create cancellable context
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
@@ -135,11 +219,28 @@ func main() {
 
 	// create watcher for resources, not for CRD
 	logs.Infof("Start watching non-CRD resources")
-	resourcesWatcher = watcher.NewWatcher(ctx, clusterClient, resourceHandler)
+	resourcesWatcher = watcher.NewWatcher(ctx, clusterClient, metadataClient, time.Duration(resyncPeriod)*time.Second, resourceHandler)
+
+	// watch CRDs to refresh discovery, in background as it is not required to run admissions
+	crdsWatcher = watcher.NewWatcher(ctx, clusterClient, metadataClient, time.Duration(resyncPeriod)*time.Second, crdHandler)
+	go func() {
+		crd := schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+		crdKind := schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"}
+		err := crdsWatcher.Watch("discovery", []watcher.Resource{{GVR: crd, GVK: crdKind, MetadataOnly: true}})
+		if err != nil {
+			logs.Warnf("Unable to watch %s, new CRDs are only discovered on cache miss: %v", CustomResourceDefinitions, err)
+			return
+		}
+		crdsSynced.Store(true)
+	}()
+
+	// retry admissions whose kinds could not be resolved
+	retryQueue = workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Second, 5*time.Minute))
+	go retryAdmissions(ctx)
 
 	// create watcher and load resources
 	logs.Infof("Start watching CRD resources")
-	admissionsWatcher = watcher.NewWatcher(ctx, clusterClient, admissionHandler)
+	admissionsWatcher = watcher.NewWatcher(ctx, clusterClient, nil, time.Duration(resyncPeriod)*time.Second, admissionHandler)
 
 	// load cluster CRD
 	gvr, err := discoveryClient.GetGVRFromResource(ClusterCrd)
@@ -161,11 +262,38 @@ func main() {
 		logs.Fatalf("%v", err)
 	}
 
+	// start leader election
+	if leaderElection {
+		for _, crd := range []string{ClusterCrd, NamespaceCrd} {
+			gvk, err := discoveryClient.GetGVKFromResource(crd)
+			if err != nil {
+				logs.Fatalf("%v", err)
+			}
+			admissionKinds = append(admissionKinds, utils.GVKToString(gvk))
+		}
+		identity, _ := os.Hostname()
+		err = election.Run(ctx, clusterConfig, namespace, leaderName, identity, reloadLeaderOnlyAdmissions)
+		if err != nil {
+			logs.Fatalf("Unable to start leader election: %v", err)
+		}
+	}
+
+	// create recorder
+	if recordFile != "" {
+		admissionRecorder, err = recorder.NewRecorder(recordFile, recordSampling, recordMaxSize, recordMaxFiles)
+		if err != nil {
+			logs.Fatalf("Unable to create recorder: %v", err)
+		}
+		logs.Infof("Recording admission requests in %s", recordFile)
+	}
+
 	// start webhook server
 	go func() {
 		logs.Infof("Start webhook server")
 		http.HandleFunc("/mutate", serveMutate)
 		http.HandleFunc("/validate", serveValidate)
+		http.HandleFunc("/validate-admission", serveValidateAdmission)
+		http.HandleFunc("/metrics", metrics.Handler)
 		addr := fmt.Sprintf("%s:%d", ip, port)
 		err = http.ListenAndServeTLS(addr, tlsCert, tlsKey, nil)
 		if err != nil {
@@ -173,58 +301,165 @@ func main() {
 		}
 	}()
 
+	// start saving states
+	persistDone := make(chan struct{})
+	go func() {
+		persistStates(ctx, time.Duration(stateInterval)*time.Second)
+		close(persistDone)
+	}()
+
 	// wait forever
 	<-ctx.Done()
+	<-persistDone
+	if admissionRecorder != nil {
+		// write queued records
+		_ = admissionRecorder.Close()
+	}
 	os.Exit(0)
 }
 
-func admissionHandler(action int, obj *unstructured.Unstructured, _ *unstructured.Unstructured) {
+func admissionHandler(action int, obj *unstructured.Unstructured, old *unstructured.Unstructured) {
+	loadAdmission(action, obj, old, false)
+}
+
+// loadAdmission adds, updates or deletes an admission.
+//
+// With fresh, the state of the existing code is not migrated, and jsa_created is called for all existing objects,
+// like when the admission is loaded for the first time.
+func loadAdmission(action int, obj *unstructured.Unstructured, old *unstructured.Unstructured, fresh bool) {
 	gvk := utils.GVKToString(obj.GroupVersionKind())
 	ns := obj.GetNamespace()
 	name := obj.GetName()
-	content := obj.UnstructuredContent()
-	js, _, _ := unstructured.NestedString(content, "spec", "js")
-	kinds, _, _ := unstructured.NestedStringSlice(content, "spec", "kinds")
+	key := newAdmissionKey(obj)
 
-	//
-	res := make([]string, 0)
-	watch := make([]schema.GroupVersionResource, 0)
-	for _, kind := range kinds {
-		kr, err := discoveryClient.GetGVRFromResource(kind)
-		if err != nil {
-			logs.Errorf("CRD %s %s: invalid resource %s", gvk, name, kind)
-			return
-		}
-		kk, err := discoveryClient.GetGVKFromResource(kind)
-		if err != nil {
-			logs.Errorf("CRD %s %s: invalid kind %s", gvk, name, kind)
-			return
+	// delete admission, even if it is invalid
+	existing := admissions.Get(ns, name)
+	if action == watcher.DELETED || action == watcher.DELETED_INFERRED {
+		forgetAdmission(key)
+		removeIndexes(existing)
+		admissions.Remove(ns, name)
+		statePersister.Forget(ns, name)
+		if existing != nil {
+			resourcesWatcher.Release(existing.Admission.WatchOwner)
 		}
-		res = append(res, utils.GVKToString(kk))
-		watch = append(watch, kr)
+		return
 	}
 
-	// delete admission
-	if action == watcher.DELETED {
-		admissions.Remove(ns, name)
+	// skip updates of status or metadata only, like status.mutateExisting written by the controller
+	if action == watcher.UPDATED && old != nil && obj.GetGeneration() != 0 && obj.GetGeneration() == old.GetGeneration() {
 		return
 	}
 
-	logs.Infof("Admissions: add %s ns=%s name=%s kinds=%v", gvk, ns, name, res)
+	// parse spec
+	spec, err := parseAdmissionSpec(obj)
+	if err != nil {
+		logs.Errorf("CRD %s %s: %v", gvk, name, err)
+		return
+	}
+	if err = spec.checkSharedState(leaderElection); err != nil {
+		logs.Errorf("CRD %s %s: admission not loaded: %v", gvk, name, err)
+		return
+	}
+	if spec.Backend == "kubernetes" {
+		logs.Infof("Admissions: %s ns=%s name=%s uses a shared state, events are only applied on the leader", gvk, ns, name)
+	}
 
-	// watch new resources
-	for _, resource := range watch {
-		err := resourcesWatcher.Add(resource)
+	watchLabels, watchFields := "", ""
+	if spec.LabelSelector != nil {
+		watchLabels = spec.LabelSelector.String()
+	}
+	if spec.FieldSelector != nil {
+		watchFields = spec.FieldSelector.String()
+	}
+
+	// resolve kinds, retrying later if some are not found, like CRDs not installed yet
+	res := make([]string, 0)
+	watch := make([]watcher.Resource, 0)
+	// a kind may expand to several kinds, like apps/*/deployments, and several kinds may share the same GVK
+	known := make(map[string]bool)
+	watched := make(map[string]bool)
+	for _, kind := range spec.Kinds {
+		resolved, err := discoveryClient.ResolveKinds(kind)
 		if err != nil {
-			logs.Errorf("Admissions: failed to add %s ns=%s name=%s kinds=%v: %v", gvk, ns, name, res, err)
+			logs.Errorf("CRD %s %s: invalid kind %s, retrying later: %v", gvk, name, kind, err)
+			retryAdmission(key)
 			return
 		}
+		for _, k := range resolved {
+			resource := utils.ResourceKey(utils.GVKToString(k.GVK), k.Subresource)
+			if !known[resource] {
+				known[resource] = true
+				res = append(res, resource)
+			}
+			// subresources are never watched, and namespace admissions never receive cluster resources
+			if !k.Watchable || watched[resource] || (ns != "" && !k.Namespaced) {
+				continue
+			}
+			watched[resource] = true
+			watch = append(watch, watcher.Resource{
+				GVR:           k.GVR,
+				GVK:           k.GVK,
+				Namespace:     ns,
+				StripPaths:    spec.StripPaths,
+				MetadataOnly:  spec.MetadataOnly,
+				LabelSelector: watchLabels,
+				FieldSelector: watchFields,
+			})
+		}
 	}
+	forgetAdmission(key)
 
-	// we need to lock all resources to prevent losing them during initialisation from informer
-	for _, resource := range res {
-		resourcesWatcher.LockResource(resource)
-		defer resourcesWatcher.UnlockResource(resource)
+	logs.Infof("Admissions: add %s ns=%s name=%s kinds=%v", gvk, ns, name, res)
+
+	// watch resources with a new owner, so resources of the existing code are kept until it is replaced
+	watchOwner := fmt.Sprintf("admission:%s/%s#%d", ns, name, watchSequence.Add(1))
+	existingOwner := ""
+	if existing != nil {
+		existingOwner = existing.Admission.WatchOwner
+	}
+	// on failure the new resources are released, released after unlocking resources as purging the cache locks them
+	releaseOwners := []string{watchOwner}
+	defer func() {
+		for _, owner := range releaseOwners {
+			if owner != "" {
+				resourcesWatcher.Release(owner)
+			}
+		}
+	}()
+	err = resourcesWatcher.Watch(watchOwner, watch)
+	if err != nil {
+		logs.Errorf("Admissions: failed to add %s ns=%s name=%s kinds=%v: %v", gvk, ns, name, res, err)
+		return
+	}
+
+	// we need to lock all resources to prevent losing them during initialisation from informer,
+	// including resources of the existing admission, as its events may be needed for migration
+	locked := res
+	if existing != nil {
+		locked = append(locked, existing.Admission.Resources...)
+	}
+	// wait for queued events to be delivered to the existing code, whose state may be migrated,
+	// without holding locks as events may lookup resources, until no more events are queued while locked
+	for {
+		if existing != nil && existing.IsValid && !fresh {
+			existing.Events.Drain()
+		}
+		resourcesWatcher.LockResources(locked)
+		if existing == nil || !existing.IsValid || fresh || existing.Events.Idle() {
+			break
+		}
+		resourcesWatcher.UnlockResources(locked)
+	}
+	defer resourcesWatcher.UnlockResources(locked)
+
+	// create state backend, shared state is already persisted
+	owner := metav1.OwnerReference{APIVersion: obj.GetAPIVersion(), Kind: obj.GetKind(), Name: name, UID: obj.GetUID()}
+	persist := spec.Persist
+	var sharedState *state.KubernetesBackend
+	if spec.Backend == "kubernetes" {
+		cmNamespace, cmName := statePersister.ObjectKey(ns, name)
+		sharedState = state.NewKubernetesBackend(clusterClient, cmNamespace, cmName, owner, stateMaxSize)
+		persist = false
 	}
 
 	// create or update admission
@@ -232,26 +467,131 @@ func admissionHandler(action int, obj *unstructured.Unstructured, _ *unstructure
 		Namespace:  ns,
 		Name:       name,
 		Resources:  res,
-		Javascript: js,
-		Timeout:    timeout,
+		Javascript: spec.Js,
+		Timeout:    spec.jsTimeout(),
+		Limits:     jsLimits,
+		Persist:    persist,
+		Owner:      owner,
+		WatchOwner: watchOwner,
+		LeaderOnly: spec.LeaderOnly,
+		Workers:    eventWorkers,
+		Retries:    eventRetries,
+
+		LabelSelector: spec.LabelSelector,
+		FieldSelector: spec.FieldSelector,
+		Indexes:       spec.Indexes,
+		Resync:        spec.Resync,
+		Background:    spec.Background,
+
+		GenerateSync:   spec.GenerateSync,
+		GenerateDelete: spec.GenerateDelete,
+		Lookup: func(kind string, namespace string, index string, value string) ([]*unstructured.Unstructured, error) {
+			resolved, err := discoveryClient.ResolveKinds(kind)
+			if err != nil {
+				return nil, err
+			}
+			for _, k := range resolved {
+				resource := utils.GVKToString(k.GVK)
+				if watched[resource] {
+					return resourcesWatcher.LookupResources(resource, namespace, index, value)
+				}
+			}
+			return nil, fmt.Errorf("kind %s is not in admission kinds", kind)
+		},
 	}
+	if sharedState != nil {
+		adm.State = sharedState
+	}
+	isNew := admissions.Get(ns, name) == nil
 	code, err := admissions.Upsert(adm)
 	if err != nil {
+		// existing code has been removed
+		releaseOwners = append(releaseOwners, existingOwner)
 		logs.Errorf("Admissions: failed to add %s ns=%s name=%s kinds=%v: %v", gvk, ns, name, res, err)
 		return
 	}
+	if code.Previous == nil {
+		// existing code has already been replaced, so the new code keeps its resources even on failure
+		releaseOwners = []string{existingOwner}
+	}
+
+	// drop new code on failure, as previous code is still serving
+	defer func() {
+		if !code.IsValid && code.Previous != nil {
+			code.Close()
+		}
+	}()
+
+	// check index functions
+	for _, index := range spec.Indexes {
+		if index.Function != "" && !code.Context.HasFunction(index.Function) {
+			logs.Errorf("Admissions: failed to add %s ns=%s name=%s kinds=%v: index function %s not found", gvk, ns, name, res, index.Function)
+			return
+		}
+	}
+
+	// restore persisted state, only when admission is loaded for the first time
+	restored := false
+	if persist && isNew {
+		snapshot, found, err := statePersister.Load(context.Background(), ns, name)
+		if err == nil && found {
+			err = code.Context.SetState(snapshot)
+			restored = true
+		}
+		if err != nil {
+			logs.Errorf("Admissions: failed to restore state %s ns=%s name=%s kinds=%v: %v", gvk, ns, name, res, err)
+			return
+		}
+	}
+
+	// load shared state
+	if sharedState != nil {
+		restored, err = sharedState.Load()
+		if err != nil {
+			logs.Errorf("Admissions: failed to load state %s ns=%s name=%s kinds=%v: %v", gvk, ns, name, res, err)
+			return
+		}
+	}
 
 	// initialise new admission
-	err = code.Init()
+	err = code.Init(restored)
 	if err != nil {
 		logs.Errorf("Admissions: failed to initialize %s ns=%s name=%s kinds=%v: %v", gvk, ns, name, res, err)
 		return
 	}
 
-	// call created for all resources
+	// migrate state from previous admission, still serving until this one is activated
+	migrated := make(map[string]bool)
+	if code.Previous != nil && !fresh {
+		// all queued events have been delivered to previous code, and no more can be added while resources are locked
+		err = code.Migrate(code.Previous)
+		if err != nil {
+			logs.Errorf("Admissions: failed to migrate %s ns=%s name=%s kinds=%v: %v", gvk, ns, name, res, err)
+			return
+		}
+		for _, resource := range code.Previous.Admission.Resources {
+			migrated[resource] = true
+		}
+	}
+
+	// replace indexes of existing admission, before calling created so they can be used in lookups
+	removeIndexes(existing)
+	for _, resource := range res {
+		for _, index := range spec.Indexes {
+			resourcesWatcher.AddIndexer(resource, adm.IndexName(index.Name), code.Indexer(index))
+		}
+	}
+
+	// call created for all resources, except those already known by the migrated or restored state, or if not leader
 	// synced by design as resources are locked, preventing resourceHandler to run
 	for _, resource := range res {
+		if migrated[resource] || restored || (spec.LeaderOnly && !election.IsLeader()) {
+			continue
+		}
 		for _, obj := range resourcesWatcher.GetResources(resource, code.Admission.Namespace) {
+			if !code.Admission.Matches(obj) {
+				continue
+			}
 			err = code.Created(obj)
 			if err != nil {
 				logs.Errorf("Admissions: failed to initialize all created() %s ns=%s name=%s kinds=%v: %v", gvk, ns, name, res, err)
@@ -260,21 +600,122 @@ func admissionHandler(action int, obj *unstructured.Unstructured, _ *unstructure
 		}
 	}
 
-	// make admission valid
-	code.IsValid = true
+	// reconcile restored state with objects changed while it was not running
+	if restored && code.Context.HasFunction(admission.JsaResync) && !(spec.LeaderOnly && !election.IsLeader()) {
+		objs, err := resyncObjects(adm)
+		if err == nil {
+			err = code.Resync(objs)
+		}
+		if err != nil {
+			logs.Errorf("Admissions: failed to initialize resync() %s ns=%s name=%s kinds=%v: %v", gvk, ns, name, res, err)
+			return
+		}
+	}
+
+	// make admission valid, then stop watching resources of the replaced code
+	admissions.Activate(code)
+	if !code.IsValid {
+		// admission has been removed or replaced in between
+		return
+	}
+	releaseOwners = []string{existingOwner}
 	logs.Infof("Admissions: success %s ns=%s name=%s kinds=%v", gvk, ns, name, res)
+
+	// generate objects for existing trigger objects, queued while resources are locked so before events received afterwards
+	if code.Context.HasFunction(admission.JsaGenerate) && !(spec.LeaderOnly && !election.IsLeader()) {
+		if err = generateExisting(code); err != nil {
+			logs.Errorf("Admissions: failed to generate objects for existing objects %s ns=%s name=%s: %v", gvk, ns, name, err)
+		}
+	}
+
+	// start calling jsa_resync, until admission is replaced or removed
+	if code.IsValid && spec.Resync > 0 && code.Context.HasFunction(admission.JsaResync) {
+		go resyncAdmission(code)
+	}
+
+	// start background scans, until admission is replaced or removed
+	if code.IsValid && spec.Background > 0 && code.Context.HasFunction(admission.JsaValidate) {
+		go scanAdmission(code)
+	}
+
+	// start patching existing objects, until admission is replaced or removed
+	if code.IsValid && spec.MutateExisting && code.Context.HasFunction(admission.JsaMutate) {
+		go mutateExistingAdmission(code, spec, watch)
+	}
+
+	// start deleting objects at each time of schedule, until admission is replaced or removed
+	if code.IsValid && spec.CleanupSchedule != nil && code.Context.HasFunction(admission.JsaCleanup) {
+		go cleanupAdmission(code, spec, watch)
+	}
+
+	// start calling scheduled functions, until admission is replaced or removed
+	if code.IsValid {
+		for _, schedule := range spec.Schedules {
+			go scheduleAdmission(code, schedule)
+		}
+	}
+}
+
+// removeIndexes removes indexes declared by the admission.
+func removeIndexes(code *admission.AdmissionCode) {
+	if code == nil {
+		return
+	}
+	for _, resource := range code.Admission.Resources {
+		for _, index := range code.Admission.Indexes {
+			resourcesWatcher.RemoveIndexer(resource, code.Admission.IndexName(index.Name))
+		}
+	}
 }
 
+// resourceHandler queues events to admissions, so a slow admission does not block informers.
 func resourceHandler(action int, obj *unstructured.Unstructured, old *unstructured.Unstructured) {
 	gvk := utils.GVKToString(obj.GroupVersionKind())
+	key := fmt.Sprintf("%s ns=%s name=%s", gvk, obj.GetNamespace(), obj.GetName())
 	for _, code := range admissions.Find(gvk, obj.GetNamespace()) {
+		if code.Admission.LeaderOnly && !election.IsLeader() {
+			continue
+		}
+		// objects leaving the selectors are still received, as their previous version matches
+		if !code.Admission.Matches(obj) && (old == nil || !code.Admission.Matches(old)) {
+			continue
+		}
+		code := code
 		switch action {
 		case watcher.CREATED:
-			_ = code.Created(obj)
+			code.Events.Add(key, &events.Event{Name: "created " + key, Run: func() error { return code.Created(obj) }})
 		case watcher.UPDATED:
-			_ = code.Updated(obj, old)
+			code.Events.Add(key, &events.Event{Name: "updated " + key, Run: func() error { return code.Updated(obj, old) }})
 		case watcher.DELETED:
-			_ = code.Deleted(obj)
+			code.Events.Add(key, &events.Event{Name: "deleted " + key, Run: func() error { return code.Deleted(obj, false) }})
+		case watcher.DELETED_INFERRED:
+			code.Events.Add(key, &events.Event{Name: "deleted (inferred) " + key, Run: func() error { return code.Deleted(obj, true) }})
+		}
+		// generate objects after the event, so jsa_generate sees the updated state
+		if !code.Context.HasFunction(admission.JsaGenerate) {
+			continue
+		}
+		switch {
+		case action == watcher.CREATED:
+			code.Events.Add(key, &events.Event{Name: "generate " + key, Run: func() error { return generateObjects(code, admissionv1.Create, obj) }})
+		case action == watcher.UPDATED && code.Admission.GenerateSync:
+			code.Events.Add(key, &events.Event{Name: "generate " + key, Run: func() error { return generateObjects(code, admissionv1.Update, obj) }})
+		case (action == watcher.DELETED || action == watcher.DELETED_INFERRED) && code.Admission.GenerateDelete:
+			code.Events.Add(key, &events.Event{Name: "delete generated " + key, Run: func() error { return deleteGenerated(code, obj) }})
+		}
+	}
+}
+
+// reloadLeaderOnlyAdmissions reloads admissions with spec.events.leaderOnly when becoming the leader,
+// as their events have been skipped while not being the leader, so their state is rebuilt from all existing objects.
+func reloadLeaderOnlyAdmissions() {
+	for _, kind := range admissionKinds {
+		admissionsWatcher.LockResource(kind)
+		for _, obj := range admissionsWatcher.GetResources(kind, "") {
+			if spec, err := parseAdmissionSpec(obj); err == nil && spec.LeaderOnly {
+				loadAdmission(watcher.UPDATED, obj, nil, true)
+			}
 		}
+		admissionsWatcher.UnlockResource(kind)
 	}
 }
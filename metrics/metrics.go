@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Counter is a monotonic counter with labels, exposed in the Prometheus text format.
+type Counter struct {
+	mux    sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+var (
+	registryMux sync.Mutex
+	registry    = make([]*Counter, 0)
+)
+
+// NewCounter creates and registers a counter, exposed by Handler.
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	registryMux.Lock()
+	defer registryMux.Unlock()
+	registry = append(registry, c)
+	return c
+}
+
+// Add adds n to the counter with these label values, in the order of labels.
+func (c *Counter) Add(n float64, values ...string) {
+	if len(values) != len(c.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", c.name, len(c.labels), len(values)))
+	}
+	pairs := make([]string, len(values))
+	for i, value := range values {
+		pairs[i] = fmt.Sprintf("%s=%q", c.labels[i], value)
+	}
+	key := strings.Join(pairs, ",")
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.values[key] += n
+}
+
+// Inc adds 1 to the counter with these label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Get returns the value of the counter with these label values.
+func (c *Counter) Get(values ...string) float64 {
+	pairs := make([]string, len(values))
+	for i, value := range values {
+		pairs[i] = fmt.Sprintf("%s=%q", c.labels[i], value)
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.values[strings.Join(pairs, ",")]
+}
+
+func (c *Counter) write(sb *strings.Builder) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "" {
+			fmt.Fprintf(sb, "%s %v\n", c.name, c.values[key])
+		} else {
+			fmt.Fprintf(sb, "%s{%s} %v\n", c.name, key, c.values[key])
+		}
+	}
+}
+
+// Handler serves all registered metrics.
+func Handler(w http.ResponseWriter, _ *http.Request) {
+	sb := &strings.Builder{}
+	registryMux.Lock()
+	for _, c := range registry {
+		c.write(sb)
+	}
+	registryMux.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(sb.String()))
+}
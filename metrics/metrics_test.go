@@ -0,0 +1,28 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_runs_total", "Number of runs.", "admission", "result")
+	c.Inc("ns.a", "success")
+	c.Inc("ns.a", "success")
+	c.Add(3, "ns.a", "error")
+	if c.Get("ns.a", "success") != 2 || c.Get("ns.b", "success") != 0 {
+		t.Fatalf("failed")
+	}
+
+	w := httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("GET", "/metrics", nil))
+	expected := `# HELP test_runs_total Number of runs.
+# TYPE test_runs_total counter
+test_runs_total{admission="ns.a",result="error"} 3
+test_runs_total{admission="ns.a",result="success"} 2
+`
+	if !strings.Contains(w.Body.String(), expected) {
+		t.Fatalf("failed: %s", w.Body.String())
+	}
+}
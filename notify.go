@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/admission"
+	"github.com/momiji/js-admissions-controller/logs"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	EventNormal  = "Normal"
+	EventWarning = "Warning"
+	EventSource  = "js-admissions-controller"
+)
+
+var EventGVR = schema.GroupVersionResource{Version: "v1", Resource: "events"}
+
+// recordEvent creates a Kubernetes event on the admission, visible with kubectl describe.
+//
+// Events of cluster admissions are created in the default namespace, as the API server requires for cluster objects, and failures are only logged.
+func recordEvent(adm *admission.Admission, eventType string, reason string, message string) {
+	ns := adm.Namespace
+	if ns == "" {
+		ns = metav1.NamespaceDefault
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	event := &unstructured.Unstructured{Object: map[string]interface{}{
+		"involvedObject": map[string]interface{}{
+			"apiVersion": adm.Owner.APIVersion,
+			"kind":       adm.Owner.Kind,
+			"name":       adm.Name,
+			"namespace":  adm.Namespace,
+			"uid":        string(adm.Owner.UID),
+		},
+		"type":           eventType,
+		"reason":         reason,
+		"message":        message,
+		"source":         map[string]interface{}{"component": EventSource},
+		"firstTimestamp": now,
+		"lastTimestamp":  now,
+		"count":          int64(1),
+	}}
+	event.SetAPIVersion("v1")
+	event.SetKind("Event")
+	event.SetNamespace(ns)
+	event.SetGenerateName(adm.Name + ".")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := clusterClient.Resource(EventGVR).Namespace(ns).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		logs.Errorf("Unable to record event %s for %s: %v", reason, adm.FullName(), err)
+	}
+}
+
+// writeStatus writes status.<field> of the admission with a merge patch, leaving other fields of status unchanged.
+func writeStatus(ctx context.Context, adm *admission.Admission, field string, value interface{}) error {
+	data, err := json.Marshal(map[string]interface{}{"status": map[string]interface{}{field: value}})
+	if err != nil {
+		return err
+	}
+	gvr := schema.GroupVersionResource{Group: GroupCrd, Version: VersionCrd, Resource: "clusterjsadmissions"}
+	if adm.Namespace != "" {
+		gvr.Resource = "jsadmissions"
+	}
+	_, err = clusterClient.Resource(gvr).Namespace(adm.Namespace).Patch(ctx, adm.Name, types.MergePatchType, data, metav1.PatchOptions{}, "status")
+	return err
+}
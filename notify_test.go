@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/momiji/js-admissions-controller/admission"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newEventsClient returns a fake client rejecting events whose namespace does not match their involved object, like the api server.
+func newEventsClient() *fake.FakeDynamicClient {
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{EventGVR: "EventList"})
+	client.PrependReactor("create", "events", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		event := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		involved, _, _ := unstructured.NestedString(event.Object, "involvedObject", "namespace")
+		if involved != event.GetNamespace() && !(involved == "" && event.GetNamespace() == metav1.NamespaceDefault) {
+			return true, nil, fmt.Errorf("does not match event.namespace")
+		}
+		return false, nil, nil
+	})
+	return client
+}
+
+// listEvents returns the reasons of the events of a namespace.
+func listEvents(client *fake.FakeDynamicClient, namespace string) []string {
+	list, _ := client.Resource(EventGVR).Namespace(namespace).List(context.Background(), metav1.ListOptions{})
+	reasons := make([]string, 0)
+	for _, event := range list.Items {
+		reason, _, _ := unstructured.NestedString(event.Object, "reason")
+		reasons = append(reasons, reason)
+	}
+	return reasons
+}
+
+func TestRecordEvent(t *testing.T) {
+	client := newEventsClient()
+	clusterClient = client
+
+	// events of cluster admissions are created in the default namespace
+	adm := &admission.Admission{Name: "cluster", Owner: metav1.OwnerReference{APIVersion: "momiji.com/v1", Kind: "ClusterJsAdmission", UID: "cluster-uid"}}
+	recordEvent(adm, EventNormal, "Deleted", "deleted")
+	if reasons := listEvents(client, metav1.NamespaceDefault); len(reasons) != 1 || reasons[0] != "Deleted" {
+		t.Fatalf("failed")
+	}
+
+	// events of namespace admissions are created in their namespace
+	adm = &admission.Admission{Namespace: "ns", Name: "adm", Owner: metav1.OwnerReference{APIVersion: "momiji.com/v1", Kind: "JsAdmission", UID: "adm-uid"}}
+	recordEvent(adm, EventWarning, "CleanupFailed", "failed")
+	if reasons := listEvents(client, "ns"); len(reasons) != 1 || reasons[0] != "CleanupFailed" {
+		t.Fatalf("failed")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/logs"
+	"github.com/momiji/js-admissions-controller/state"
+)
+
+// persistStates saves states of admissions with spec.state.persist at regular interval, and a last time on shutdown.
+//
+// An interval <= 0 disables periodic saves, so states are only saved on shutdown.
+func persistStates(ctx context.Context, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			saveCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			saveStates(saveCtx)
+			cancel()
+			return
+		case <-tick:
+			saveStates(ctx)
+		}
+	}
+}
+
+func saveStates(ctx context.Context) {
+	for _, code := range admissions.List() {
+		adm := code.Admission
+		if !adm.Persist {
+			continue
+		}
+		err := statePersister.Save(ctx, &state.Snapshot{
+			Namespace: adm.Namespace,
+			Name:      adm.Name,
+			Owner:     adm.Owner,
+			State:     code.Context.GetState(),
+		})
+		if err != nil {
+			logs.Errorf("State: failed to save ns=%s name=%s: %v", adm.Namespace, adm.Name, err)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/admission"
+)
+
+func TestPersistStates_NoInterval(t *testing.T) {
+	admissions = admission.NewAdmissions()
+
+	// an interval <= 0 only saves states on shutdown
+	for _, interval := range []time.Duration{0, -time.Second} {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			persistStates(ctx, interval)
+			close(done)
+		}()
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("failed")
+		}
+	}
+}
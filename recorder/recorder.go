@@ -0,0 +1,232 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/logs"
+	admission "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// Redacted replaces the values of sensitive fields, like data of Secrets
+	Redacted = "REDACTED"
+	// queueSize is the max number of records waiting to be written, further records are dropped
+	queueSize = 1000
+)
+
+// Record is a recorded admission request and the response sent, as one line of JSON in the recording.
+type Record struct {
+	Time     time.Time                    `json:"time"`
+	Path     string                       `json:"path"`
+	Request  *admission.AdmissionRequest  `json:"request"`
+	Response *admission.AdmissionResponse `json:"response"`
+}
+
+// Recorder writes sampled records to a file, rotated to file.1, file.2... when it reaches its max size.
+//
+// Records are written asynchronously, so recording never delays admission responses, and values of Secrets data are redacted.
+type Recorder struct {
+	mux      sync.RWMutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	sampling float64
+	file     *os.File
+	size     int64
+	closed   bool
+	records  chan *Record
+	done     chan struct{}
+}
+
+// NewRecorder creates a recorder appending to path, recording this ratio of requests between 0 and 1,
+// and keeping maxFiles rotated files of maxSize bytes.
+func NewRecorder(path string, sampling float64, maxSize int64, maxFiles int) (*Recorder, error) {
+	r := &Recorder{path: path, maxSize: maxSize, maxFiles: maxFiles, sampling: sampling, records: make(chan *Record, queueSize), done: make(chan struct{})}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	go r.writer()
+	return r, nil
+}
+
+func (r *Recorder) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+// rotate renames file.N-1 to file.N... and file to file.1, dropping the oldest file, then opens a new file.
+func (r *Recorder) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	_ = os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxFiles))
+	for i := r.maxFiles - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.maxFiles > 0 {
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// Record queues a request and its response to be written, if sampled.
+//
+// Request and response must not be modified afterwards, and an error is returned if the record is dropped as too many records are waiting.
+func (r *Recorder) Record(path string, request *admission.AdmissionRequest, response *admission.AdmissionResponse) error {
+	if r.sampling < 1 && rand.Float64() >= r.sampling {
+		return nil
+	}
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	if r.closed {
+		return fmt.Errorf("recorder is closed")
+	}
+	select {
+	case r.records <- &Record{Time: time.Now(), Path: path, Request: request, Response: response}:
+		return nil
+	default:
+		return fmt.Errorf("too many records waiting to be written, record dropped")
+	}
+}
+
+// writer writes queued records until the recorder is closed.
+func (r *Recorder) writer() {
+	defer close(r.done)
+	for record := range r.records {
+		if err := r.write(redact(record)); err != nil {
+			logs.Errorf("Unable to record admission request: %v", err)
+		}
+	}
+}
+
+func (r *Recorder) write(record *Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if r.size > 0 && r.size+int64(len(data)) > r.maxSize {
+		if err = r.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := r.file.Write(data)
+	r.size += int64(n)
+	return err
+}
+
+// Close writes all queued records, then closes the current file.
+func (r *Recorder) Close() error {
+	r.mux.Lock()
+	if r.closed {
+		r.mux.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.records)
+	r.mux.Unlock()
+	<-r.done
+	return r.file.Close()
+}
+
+// redact returns a copy of the record without the values of Secrets data and stringData, in objects and patch.
+func redact(record *Record) *Record {
+	if record.Request == nil || record.Request.Kind.Group != "" || record.Request.Kind.Kind != "Secret" {
+		return record
+	}
+	request := *record.Request
+	request.Object = redactObject(request.Object)
+	request.OldObject = redactObject(request.OldObject)
+	redacted := *record
+	redacted.Request = &request
+	if record.Response != nil && len(record.Response.Patch) > 0 {
+		response := *record.Response
+		response.Patch = redactPatch(response.Patch)
+		redacted.Response = &response
+	}
+	return &redacted
+}
+
+func redactObject(raw runtime.RawExtension) runtime.RawExtension {
+	if len(raw.Raw) == 0 {
+		return raw
+	}
+	obj := make(map[string]interface{})
+	if err := json.Unmarshal(raw.Raw, &obj); err != nil {
+		return runtime.RawExtension{}
+	}
+	for _, field := range []string{"data", "stringData"} {
+		if values, ok := obj[field].(map[string]interface{}); ok {
+			for key := range values {
+				values[key] = Redacted
+			}
+		}
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return runtime.RawExtension{}
+	}
+	return runtime.RawExtension{Raw: data}
+}
+
+// redactPatch replaces values of operations on data and stringData, or the whole object.
+func redactPatch(patch []byte) []byte {
+	ops := make([]map[string]interface{}, 0)
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil
+	}
+	for _, op := range ops {
+		path, _ := op["path"].(string)
+		if _, ok := op["value"]; ok && (path == "" || path == "/" || strings.HasPrefix(path, "/data") || strings.HasPrefix(path, "/stringData")) {
+			op["value"] = Redacted
+		}
+	}
+	data, err := json.Marshal(ops)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// ReadRecords reads all records of a file, ignoring lines that are not records, like a truncated last line.
+func ReadRecords(path string) ([]*Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := make([]*Record, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		record := &Record{}
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil || record.Request == nil || record.Response == nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,73 @@
+package recorder
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	admission "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestRecorder_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	r, err := NewRecorder(path, 1, 500, 2)
+	if err != nil {
+		t.Fatalf("failed")
+	}
+	for i := 0; i < 10; i++ {
+		err = r.Record("/validate", &admission.AdmissionRequest{Name: "pod", Operation: admission.Create}, &admission.AdmissionResponse{Allowed: true})
+		if err != nil {
+			t.Fatalf("failed")
+		}
+	}
+	_ = r.Close()
+
+	// current file and 2 rotated files, the oldest being dropped
+	if _, err = os.Stat(path + ".2"); err != nil {
+		t.Fatalf("failed")
+	}
+	if _, err = os.Stat(path + ".3"); err == nil {
+		t.Fatalf("failed")
+	}
+	records, err := ReadRecords(path)
+	if err != nil || len(records) == 0 || records[0].Request.Name != "pod" || !records[0].Response.Allowed || records[0].Path != "/validate" {
+		t.Fatalf("failed")
+	}
+}
+
+func TestRecorder_Sampling(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	r, _ := NewRecorder(path, 0, 1000, 1)
+	_ = r.Record("/validate", &admission.AdmissionRequest{}, &admission.AdmissionResponse{})
+	_ = r.Close()
+	records, err := ReadRecords(path)
+	if err != nil || len(records) != 0 {
+		t.Fatalf("failed")
+	}
+}
+
+func TestRecorder_Redact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	r, _ := NewRecorder(path, 1, 1024*1024, 1)
+	secret := []byte(`{"apiVersion":"v1","kind":"Secret","metadata":{"name":"s"},"data":{"password":"c2VjcmV0"},"stringData":{"token":"secret"}}`)
+	request := &admission.AdmissionRequest{Kind: metav1.GroupVersionKind{Version: "v1", Kind: "Secret"}, Object: runtime.RawExtension{Raw: secret}}
+	patch := []byte(`[{"op":"add","path":"/data/key","value":"c2VjcmV0"},{"op":"add","path":"/metadata/labels","value":{"a":"b"}}]`)
+	_ = r.Record("/mutate", request, &admission.AdmissionResponse{Allowed: true, Patch: patch})
+	_ = r.Close()
+
+	// secret values are never written, while the recorded request is left untouched
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "c2VjcmV0") || strings.Contains(string(data), `"secret"`) || !strings.Contains(string(data), "password") {
+		t.Fatalf("failed")
+	}
+	records, err := ReadRecords(path)
+	if err != nil || len(records) != 1 || string(records[0].Response.Patch) != `[{"op":"add","path":"/data/key","value":"REDACTED"},{"op":"add","path":"/metadata/labels","value":{"a":"b"}}]` {
+		t.Fatalf("failed")
+	}
+	if !strings.Contains(string(request.Object.Raw), "c2VjcmV0") {
+		t.Fatalf("failed")
+	}
+}
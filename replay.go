@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/recorder"
+	"github.com/momiji/js-admissions-controller/utils"
+	"github.com/spf13/pflag"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// replayDiff is the difference between a recorded response and the response of candidate admissions.
+type replayDiff struct {
+	Record  *recorder.Record
+	Changes []string
+}
+
+// replayCommand replays recorded requests against candidate admissions, returning the exit code.
+func replayCommand(args []string) int {
+	flags := pflag.NewFlagSet("replay", pflag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [flags] --admissions admissions.yaml records.jsonl...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	admissionFiles := flags.StringSlice("admissions", nil, "Files of candidate admissions")
+	objectFiles := flags.StringSlice("objects", nil, "Files of objects passed to jsa_created on initialization, and available to jsa_lookup")
+	flags.IntVar(&timeout, "timeout", DefaultTimeout, "Execution timeout in seconds for javascript code, unless set by spec.timeout")
+	failOnChange := flags.Bool("failOnChange", false, "Exit with code 1 if any response changed")
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 || len(*admissionFiles) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	// read records, oldest first
+	records := make([]*recorder.Record, 0)
+	for _, file := range flags.Args() {
+		list, err := recorder.ReadRecords(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read %s: %v\n", file, err)
+			return 2
+		}
+		records = append(records, list...)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+
+	// load candidate admissions
+	objs, err := readAdmissions(*admissionFiles)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read admissions: %v\n", err)
+		return 2
+	}
+	seeds := make([]*unstructured.Unstructured, 0)
+	for _, file := range *objectFiles {
+		list, err := readObjects(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read objects: %v\n", err)
+			return 2
+		}
+		seeds = append(seeds, list...)
+	}
+	gvks := make([]schema.GroupVersionKind, 0)
+	for _, record := range records {
+		gvks = append(gvks, schema.GroupVersionKind(record.Request.Kind))
+	}
+	if _, err = loadOfflineAdmissions(objs, seeds, gvks); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load admissions: %v\n", err)
+		return 2
+	}
+
+	// replay
+	replayed, changed := 0, 0
+	for _, record := range records {
+		diff := replayRecord(record)
+		if diff == nil {
+			continue
+		}
+		replayed++
+		if len(diff.Changes) == 0 {
+			continue
+		}
+		changed++
+		request := record.Request
+		fmt.Printf("CHANGED %s %s %s ns=%s name=%s at %s\n", record.Path, request.Operation, utils.GVK1ToString(request.Kind), request.Namespace, request.Name, record.Time.Format("2006-01-02T15:04:05Z07:00"))
+		for _, change := range diff.Changes {
+			fmt.Printf("    %s\n", change)
+		}
+	}
+	fmt.Printf("Replayed %d requests: %d unchanged, %d changed, %d skipped\n", replayed, replayed-changed, changed, len(records)-replayed)
+	if *failOnChange && changed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replayRecord sends a recorded request to the same path, returning the differences with the recorded response, or nil if the path is not replayed.
+func replayRecord(record *recorder.Record) *replayDiff {
+	review := &admissionv1.AdmissionReview{Request: record.Request}
+	var response *admissionv1.AdmissionResponse
+	switch record.Path {
+	case "/mutate":
+		response = mutate(review, time.Time{})
+	case "/validate":
+		response = validate(review, time.Time{})
+	default:
+		return nil
+	}
+
+	diff := &replayDiff{Record: record, Changes: make([]string, 0)}
+	old := record.Response
+	if old.Allowed != response.Allowed {
+		diff.Changes = append(diff.Changes, fmt.Sprintf("allowed: %v -> %v", old.Allowed, response.Allowed))
+	}
+	if oldMessage, message := responseMessage(old), responseMessage(response); oldMessage != message {
+		diff.Changes = append(diff.Changes, fmt.Sprintf("message: %q -> %q", oldMessage, message))
+	}
+	if oldPatch, patch := responsePatch(old), responsePatch(response); !reflect.DeepEqual(oldPatch, patch) {
+		diff.Changes = append(diff.Changes, fmt.Sprintf("patch: %s -> %s", toJson(oldPatch), toJson(patch)))
+	}
+	return diff
+}
+
+func responseMessage(response *admissionv1.AdmissionResponse) string {
+	if response.Result == nil {
+		return ""
+	}
+	return response.Result.Message
+}
+
+// responsePatch returns the operations of a JSON patch, in their original order as operations are applied in sequence.
+func responsePatch(response *admissionv1.AdmissionResponse) []interface{} {
+	ops := make([]interface{}, 0)
+	if len(response.Patch) == 0 {
+		return ops
+	}
+	if err := json.Unmarshal(response.Patch, &ops); err != nil {
+		return []interface{}{string(response.Patch)}
+	}
+	return ops
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/momiji/js-admissions-controller/recorder"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	r, err := recorder.NewRecorder(path, 1, 1024*1024, 1)
+	if err != nil {
+		t.Fatalf("failed")
+	}
+	pod := []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"p1","namespace":"default"},"spec":{"containers":[{"name":"main","image":"busybox"}]}}`)
+	request := &admissionv1.AdmissionRequest{
+		UID:       "1",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Name:      "p1",
+		Namespace: "default",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: pod},
+	}
+	// recorded before pods-count annotated pods, and validated by pods-per-node
+	_ = r.Record("/mutate", request, &admissionv1.AdmissionResponse{UID: "1", Allowed: true})
+	_ = r.Record("/validate", request, &admissionv1.AdmissionResponse{UID: "1", Allowed: true})
+	_ = r.Record("/validate-admission", request, &admissionv1.AdmissionResponse{UID: "1", Allowed: true})
+	_ = r.Close()
+
+	records, err := recorder.ReadRecords(path)
+	if err != nil || len(records) != 3 {
+		t.Fatalf("failed")
+	}
+	objs, err := readAdmissions([]string{"tests/suite/admissions.yaml"})
+	if err != nil {
+		t.Fatalf("failed")
+	}
+	if _, err = loadOfflineAdmissions(objs, nil, []schema.GroupVersionKind{{Version: "v1", Kind: "Pod"}}); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	diff := replayRecord(records[0])
+	if diff == nil || len(diff.Changes) != 1 || diff.Changes[0][:6] != "patch:" {
+		t.Fatalf("failed: %v", diff)
+	}
+	diff = replayRecord(records[1])
+	if diff == nil || len(diff.Changes) != 0 {
+		t.Fatalf("failed: %v", diff)
+	}
+	if replayRecord(records[2]) != nil {
+		t.Fatalf("failed")
+	}
+}
+
+func TestResponsePatch(t *testing.T) {
+	// operations are applied in sequence, so their order is significant
+	add := `{"op":"add","path":"/metadata/labels","value":{}}`
+	label := `{"op":"add","path":"/metadata/labels/a","value":"1"}`
+	patch := responsePatch(&admissionv1.AdmissionResponse{Patch: []byte("[" + add + "," + label + "]")})
+	reversed := responsePatch(&admissionv1.AdmissionResponse{Patch: []byte("[" + label + "," + add + "]")})
+	if len(patch) != 2 || reflect.DeepEqual(patch, reversed) {
+		t.Fatalf("failed")
+	}
+}
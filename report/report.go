@@ -0,0 +1,165 @@
+package report
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	APIVersion     = "wgpolicyk8s.io/v1alpha2"
+	Source         = "js-admissions-controller"
+	Label          = "jsadmissions.momiji.com/report"
+	RequestTimeout = 10 * time.Second
+)
+
+var (
+	PolicyReportGVR        = schema.GroupVersionResource{Group: "wgpolicyk8s.io", Version: "v1alpha2", Resource: "policyreports"}
+	ClusterPolicyReportGVR = schema.GroupVersionResource{Group: "wgpolicyk8s.io", Version: "v1alpha2", Resource: "clusterpolicyreports"}
+)
+
+// Result is the result of a policy for an object.
+type Result string
+
+const (
+	Pass  Result = "pass"
+	Fail  Result = "fail"
+	Error Result = "error"
+	Skip  Result = "skip"
+)
+
+// Report is the PolicyReport of an admission for the objects of a namespace, or the ClusterPolicyReport for cluster objects if namespace is empty.
+type Report struct {
+	Name      string
+	Namespace string
+	Policy    string
+	Owner     metav1.OwnerReference
+	Results   []interface{}
+	Summary   map[Result]int64
+}
+
+func NewReport(name string, namespace string, policy string, owner metav1.OwnerReference) *Report {
+	return &Report{
+		Name:      name,
+		Namespace: namespace,
+		Policy:    policy,
+		Owner:     owner,
+		Results:   make([]interface{}, 0),
+		Summary:   map[Result]int64{Pass: 0, Fail: 0, Error: 0, Skip: 0},
+	}
+}
+
+// Add adds the result of the policy for an object.
+func (r *Report) Add(obj *unstructured.Unstructured, result Result, message string, now time.Time) {
+	resource := map[string]interface{}{
+		"apiVersion": obj.GetAPIVersion(),
+		"kind":       obj.GetKind(),
+		"name":       obj.GetName(),
+		"uid":        string(obj.GetUID()),
+	}
+	if obj.GetNamespace() != "" {
+		resource["namespace"] = obj.GetNamespace()
+	}
+	item := map[string]interface{}{
+		"policy":    r.Policy,
+		"result":    string(result),
+		"source":    Source,
+		"scored":    true,
+		"timestamp": map[string]interface{}{"seconds": now.Unix(), "nanos": int64(now.Nanosecond())},
+		"resources": []interface{}{resource},
+	}
+	if message != "" {
+		item["message"] = message
+	}
+	r.Results = append(r.Results, item)
+	r.Summary[result]++
+}
+
+// Object returns the report as a PolicyReport or a ClusterPolicyReport.
+func (r *Report) Object() *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"results": r.Results,
+		"summary": map[string]interface{}{
+			"pass":  r.Summary[Pass],
+			"fail":  r.Summary[Fail],
+			"error": r.Summary[Error],
+			"skip":  r.Summary[Skip],
+			"warn":  int64(0),
+		},
+	}}
+	obj.SetAPIVersion(APIVersion)
+	if r.Namespace == "" {
+		obj.SetKind("ClusterPolicyReport")
+	} else {
+		obj.SetKind("PolicyReport")
+		obj.SetNamespace(r.Namespace)
+	}
+	obj.SetName(r.Name)
+	obj.SetLabels(map[string]string{Label: string(r.Owner.UID), "app.kubernetes.io/managed-by": Source})
+	obj.SetOwnerReferences([]metav1.OwnerReference{r.Owner})
+	return obj
+}
+
+// Writer creates, updates and deletes reports.
+type Writer struct {
+	client dynamic.Interface
+}
+
+func NewWriter(client dynamic.Interface) *Writer {
+	return &Writer{client: client}
+}
+
+func (w *Writer) resource(namespace string) dynamic.ResourceInterface {
+	if namespace == "" {
+		return w.client.Resource(ClusterPolicyReportGVR)
+	}
+	return w.client.Resource(PolicyReportGVR).Namespace(namespace)
+}
+
+// Write creates the report, or replaces it if it exists.
+func (w *Writer) Write(report *Report) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+	obj := report.Object()
+	client := w.resource(report.Namespace)
+	existing, err := client.Get(ctx, report.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = client.Create(ctx, obj, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	obj.SetResourceVersion(existing.GetResourceVersion())
+	_, err = client.Update(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
+
+// Prune deletes reports of the owner, except those in keep, by namespace or "" for the cluster report.
+func (w *Writer) Prune(owner metav1.OwnerReference, keep map[string]bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+	options := metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", Label, owner.UID)}
+	for _, gvr := range []schema.GroupVersionResource{PolicyReportGVR, ClusterPolicyReportGVR} {
+		list, err := w.client.Resource(gvr).List(ctx, options)
+		if err != nil {
+			return err
+		}
+		for _, item := range list.Items {
+			if keep[item.GetNamespace()] {
+				continue
+			}
+			err = w.resource(item.GetNamespace()).Delete(ctx, item.GetName(), metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package report
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func newPod(namespace string, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("Pod")
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+func TestReport_Object(t *testing.T) {
+	r := NewReport("jsa-a", "ns", "a", metav1.OwnerReference{Name: "a", UID: "uid"})
+	r.Add(newPod("ns", "p1"), Pass, "", time.Now())
+	r.Add(newPod("ns", "p2"), Fail, "denied", time.Now())
+	obj := r.Object()
+	if obj.GetKind() != "PolicyReport" || obj.GetNamespace() != "ns" || obj.GetLabels()[Label] != "uid" {
+		t.Fatalf("failed")
+	}
+	results, _, _ := unstructured.NestedSlice(obj.Object, "results")
+	if len(results) != 2 || results[1].(map[string]interface{})["message"] != "denied" {
+		t.Fatalf("failed")
+	}
+	fail, _, _ := unstructured.NestedInt64(obj.Object, "summary", "fail")
+	pass, _, _ := unstructured.NestedInt64(obj.Object, "summary", "pass")
+	if fail != 1 || pass != 1 {
+		t.Fatalf("failed")
+	}
+	if NewReport("jsa-a", "", "a", metav1.OwnerReference{}).Object().GetKind() != "ClusterPolicyReport" {
+		t.Fatalf("failed")
+	}
+}
+
+func TestWriter_WritePrune(t *testing.T) {
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		PolicyReportGVR:        "PolicyReportList",
+		ClusterPolicyReportGVR: "ClusterPolicyReportList",
+	})
+	w := NewWriter(client)
+	owner := metav1.OwnerReference{Name: "a", UID: "uid"}
+
+	// write twice, replacing the report
+	for _, ns := range []string{"ns1", "ns2", "ns1", ""} {
+		r := NewReport("jsa-a", ns, "a", owner)
+		r.Add(newPod(ns, "p"), Pass, "", time.Now())
+		if err := w.Write(r); err != nil {
+			t.Fatalf("failed: %v", err)
+		}
+	}
+
+	// prune reports of namespaces without objects anymore
+	if err := w.Prune(owner, map[string]bool{"ns1": true}); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := client.Resource(PolicyReportGVR).Namespace("ns1").Get(ctx, "jsa-a", metav1.GetOptions{}); err != nil {
+		t.Fatalf("failed")
+	}
+	if _, err := client.Resource(PolicyReportGVR).Namespace("ns2").Get(ctx, "jsa-a", metav1.GetOptions{}); err == nil {
+		t.Fatalf("failed")
+	}
+	if _, err := client.Resource(ClusterPolicyReportGVR).Get(ctx, "jsa-a", metav1.GetOptions{}); err == nil {
+		t.Fatalf("failed")
+	}
+}
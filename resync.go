@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/admission"
+	"github.com/momiji/js-admissions-controller/events"
+	"github.com/momiji/js-admissions-controller/logs"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// resyncAdmission queues calls to jsa_resync at spec.resync interval, until the admission code is closed.
+//
+// Calls are queued as events, so they are delivered in order with other events and retried on failure.
+func resyncAdmission(code *admission.AdmissionCode) {
+	adm := code.Admission
+	ticker := time.NewTicker(adm.Resync)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-code.Done():
+			return
+		case <-ticker.C:
+			if adm.LeaderOnly && !election.IsLeader() {
+				continue
+			}
+			code.Events.Add("resync", &events.Event{Name: "resync", Run: func() error {
+				objs, err := resyncObjects(adm)
+				if err != nil {
+					return err
+				}
+				logs.Tracef("Admissions: resync %s objs=%d", adm.FullName(), len(objs))
+				return code.Resync(objs)
+			}})
+		}
+	}
+}
+
+// resyncObjects returns copies of all cached objects of the admission kinds, matching its selectors.
+func resyncObjects(adm *admission.Admission) ([]*unstructured.Unstructured, error) {
+	objs := make([]*unstructured.Unstructured, 0)
+	for _, resource := range adm.Resources {
+		list, err := resourcesWatcher.LookupResources(resource, adm.Namespace, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %v", resource, err)
+		}
+		for _, obj := range list {
+			if adm.Matches(obj) {
+				objs = append(objs, obj)
+			}
+		}
+	}
+	return objs, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/momiji/js-admissions-controller/logs"
+	"github.com/momiji/js-admissions-controller/utils"
+	"github.com/momiji/js-admissions-controller/watcher"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// admissionKey identifies an admission in admissionsWatcher.
+type admissionKey struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+var (
+	retryQueue    workqueue.RateLimitingInterface
+	unresolvedMux sync.Mutex
+	unresolved    = make(map[admissionKey]bool)
+)
+
+func newAdmissionKey(obj *unstructured.Unstructured) admissionKey {
+	return admissionKey{kind: utils.GVKToString(obj.GroupVersionKind()), namespace: obj.GetNamespace(), name: obj.GetName()}
+}
+
+// retryAdmissions re-processes admissions whose kinds could not be resolved, until ctx is done.
+func retryAdmissions(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		retryQueue.ShutDown()
+	}()
+	for {
+		item, shutdown := retryQueue.Get()
+		if shutdown {
+			return
+		}
+		key := item.(admissionKey)
+		admissionsWatcher.LockResource(key.kind)
+		obj := admissionsWatcher.GetResource(key.kind, key.namespace, key.name)
+		if obj != nil {
+			logs.Infof("Admissions: retry %s ns=%s name=%s", key.kind, key.namespace, key.name)
+			admissionHandler(watcher.UPDATED, obj, nil)
+		} else {
+			forgetAdmission(key)
+		}
+		admissionsWatcher.UnlockResource(key.kind)
+		retryQueue.Done(item)
+	}
+}
+
+// retryAdmission retries later, with backoff, an admission whose kinds could not be resolved.
+func retryAdmission(key admissionKey) {
+	unresolvedMux.Lock()
+	unresolved[key] = true
+	unresolvedMux.Unlock()
+	retryQueue.AddRateLimited(key)
+}
+
+// forgetAdmission stops retrying an admission, when its kinds are resolved or it is deleted.
+func forgetAdmission(key admissionKey) {
+	unresolvedMux.Lock()
+	delete(unresolved, key)
+	unresolvedMux.Unlock()
+	retryQueue.Forget(key)
+}
+
+// retryUnresolvedAdmissions retries now all admissions whose kinds could not be resolved, like when a CRD is installed.
+func retryUnresolvedAdmissions() {
+	unresolvedMux.Lock()
+	defer unresolvedMux.Unlock()
+	for key := range unresolved {
+		retryQueue.Add(key)
+	}
+}
+
+// crdHandler refreshes discovery when CRDs are installed, updated or removed, then retries admissions whose kinds could not be resolved.
+//
+// Events received while loading existing CRDs are ignored.
+func crdHandler(_ int, obj *unstructured.Unstructured, _ *unstructured.Unstructured) {
+	if !crdsSynced.Load() {
+		return
+	}
+	logs.Debugf("Discovery: refresh on CRD %s", obj.GetName())
+	discoveryClient.Reset()
+	retryUnresolvedAdmissions()
+}
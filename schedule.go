@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/admission"
+	"github.com/momiji/js-admissions-controller/cron"
+	"github.com/momiji/js-admissions-controller/logs"
+	"github.com/momiji/js-admissions-controller/metrics"
+)
+
+var (
+	scheduleRuns   = metrics.NewCounter("jsa_schedule_runs_total", "Number of runs of spec.schedules functions.", "admission", "function", "result")
+	scheduleMissed = metrics.NewCounter("jsa_schedule_missed_total", "Number of times of spec.schedules skipped because the previous run was late.", "admission", "function")
+)
+
+// scheduleStatus is the status of a function of spec.schedules, reported in status.schedules.<function> of the admission.
+type scheduleStatus struct {
+	Schedule     string     `json:"schedule"`
+	LastRun      time.Time  `json:"lastRun"`
+	LastDuration string     `json:"lastDuration"`
+	LastError    string     `json:"lastError"`
+	Runs         int        `json:"runs"`
+	Failures     int        `json:"failures"`
+	Missed       int        `json:"missed"`
+	LastMissed   *time.Time `json:"lastMissed,omitempty"`
+}
+
+// scheduleAdmission calls the function of schedule at each time of its cron schedule, until the admission code is closed.
+//
+// Runs are not queued: when a run ends after the next times of the schedule, these times are skipped and reported as missed.
+// With spec.events.leaderOnly, functions are only called on the leader.
+func scheduleAdmission(code *admission.AdmissionCode, schedule scheduleSpec) {
+	adm := code.Admission
+	status := &scheduleStatus{Schedule: schedule.Expr}
+	next := schedule.Schedule.Next(time.Now())
+	for {
+		if next.IsZero() {
+			logs.Errorf("Admissions: schedule %s of %s never runs", schedule.Expr, adm.FullName())
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-code.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if adm.LeaderOnly && !election.IsLeader() {
+			next = schedule.Schedule.Next(next)
+			continue
+		}
+
+		runSchedule(code, schedule, status, next)
+		var missed int
+		next, missed = skipMissed(schedule.Schedule, next, time.Now())
+		if missed > 0 {
+			reportMissed(adm, schedule, status, missed)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := writeStatus(ctx, adm, "schedules", map[string]interface{}{schedule.Function: status})
+		cancel()
+		if err != nil {
+			logs.Errorf("Admissions: failed to write status of %s: %v", adm.FullName(), err)
+		}
+	}
+}
+
+// runSchedule calls the function of schedule, updating its status and metrics.
+func runSchedule(code *admission.AdmissionCode, schedule scheduleSpec, status *scheduleStatus, scheduled time.Time) {
+	adm := code.Admission
+	start := time.Now()
+	err := code.Scheduled(schedule.Function, scheduled)
+	duration := time.Since(start)
+
+	status.LastRun = start.UTC()
+	status.LastDuration = duration.Round(time.Millisecond).String()
+	status.LastError = ""
+	status.Runs++
+	if err != nil {
+		logs.Errorf("Admissions: schedule %s of %s - Error: %v", schedule.Function, adm.FullName(), err)
+		status.LastError = err.Error()
+		status.Failures++
+		scheduleRuns.Inc(adm.FullName(), schedule.Function, "error")
+		return
+	}
+	logs.Tracef("Admissions: schedule %s of %s duration=%s", schedule.Function, adm.FullName(), status.LastDuration)
+	scheduleRuns.Inc(adm.FullName(), schedule.Function, "success")
+}
+
+// reportMissed reports missed runs of schedule in its status, metrics and an event on the admission.
+func reportMissed(adm *admission.Admission, schedule scheduleSpec, status *scheduleStatus, missed int) {
+	logs.Errorf("Admissions: schedule %s of %s missed %d runs", schedule.Function, adm.FullName(), missed)
+	scheduleMissed.Add(float64(missed), adm.FullName(), schedule.Function)
+	now := time.Now().UTC()
+	status.Missed += missed
+	status.LastMissed = &now
+	recordEvent(adm, EventWarning, "ScheduleMissed", fmt.Sprintf("Schedule %s missed %d runs of %s, the previous run took %s", schedule.Expr, missed, schedule.Function, status.LastDuration))
+}
+
+// skipMissed returns the first time of schedule after now, and the number of times skipped between last and now.
+func skipMissed(schedule *cron.Schedule, last time.Time, now time.Time) (time.Time, int) {
+	missed := 0
+	next := schedule.Next(last)
+	for !next.IsZero() && !next.After(now) {
+		missed++
+		next = schedule.Next(next)
+	}
+	return next, missed
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/admission"
+	"github.com/momiji/js-admissions-controller/cron"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestParseSchedules(t *testing.T) {
+	obj := newLintAdmission([]interface{}{"pods"}, "function jsa_cron(now) {}")
+	schedules := []interface{}{map[string]interface{}{"schedule": "@hourly"}, map[string]interface{}{"schedule": "0 2 * * *", "function": "reset"}}
+	_ = unstructured.SetNestedSlice(obj.Object, schedules, "spec", "schedules")
+
+	// function defaults to jsa_cron
+	spec, err := parseAdmissionSpec(obj)
+	if err != nil || len(spec.Schedules) != 2 || spec.Schedules[0].Function != admission.JsaCron || spec.Schedules[1].Function != "reset" {
+		t.Fatalf("failed")
+	}
+
+	// scheduled functions are required
+	errors, _ := lintAdmission(obj, nil)
+	if len(errors) != 1 || !strings.Contains(errors[0], "reset") {
+		t.Fatalf("failed %v", errors)
+	}
+
+	// functions can only be scheduled once
+	schedules = append(schedules, map[string]interface{}{"schedule": "@daily"})
+	_ = unstructured.SetNestedSlice(obj.Object, schedules, "spec", "schedules")
+	if _, err = parseAdmissionSpec(obj); err == nil {
+		t.Fatalf("failed")
+	}
+}
+
+func TestSkipMissed(t *testing.T) {
+	schedule, err := cron.Parse("*/5 * * * *")
+	if err != nil {
+		t.Fatalf("failed")
+	}
+	last := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	// run ended before the next time
+	next, missed := skipMissed(schedule, last, last.Add(2*time.Minute))
+	if missed != 0 || !next.Equal(time.Date(2024, 1, 1, 10, 5, 0, 0, time.UTC)) {
+		t.Fatalf("failed")
+	}
+
+	// run ended after 10:05 and 10:10
+	next, missed = skipMissed(schedule, last, last.Add(12*time.Minute))
+	if missed != 2 || !next.Equal(time.Date(2024, 1, 1, 10, 15, 0, 0, time.UTC)) {
+		t.Fatalf("failed")
+	}
+}
+
+func TestReportMissed(t *testing.T) {
+	client := newEventsClient()
+	clusterClient = client
+	schedule, err := cron.Parse("*/5 * * * *")
+	if err != nil {
+		t.Fatalf("failed")
+	}
+	spec := scheduleSpec{Expr: "*/5 * * * *", Schedule: schedule, Function: admission.JsaCron}
+	status := &scheduleStatus{Schedule: spec.Expr, LastDuration: "12m0s"}
+
+	// missed runs of cluster admissions are recorded in the default namespace
+	adm := &admission.Admission{Name: "cluster", Owner: metav1.OwnerReference{APIVersion: "momiji.com/v1", Kind: "ClusterJsAdmission", UID: "cluster-uid"}}
+	reportMissed(adm, spec, status, 2)
+	if reasons := listEvents(client, metav1.NamespaceDefault); len(reasons) != 1 || reasons[0] != "ScheduleMissed" {
+		t.Fatalf("failed")
+	}
+	if status.Missed != 2 || status.LastMissed == nil {
+		t.Fatalf("failed")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/admission"
+	"github.com/momiji/js-admissions-controller/cron"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// admissionSpec is the parsed spec of a JsAdmission or ClusterJsAdmission.
+type admissionSpec struct {
+	Js string
+	// Timeout is the execution timeout of javascript code, or 0 to use --timeout
+	Timeout       time.Duration
+	Kinds         []string
+	Persist       bool
+	Backend       string
+	LeaderOnly    bool
+	StripPaths    []string
+	MetadataOnly  bool
+	LabelSelector labels.Selector
+	FieldSelector fields.Selector
+	Indexes       []admission.Index
+	Resync        time.Duration
+	Background    time.Duration
+	// MutateExisting enables patching cached objects with jsa_mutate, at MutateRate patches per second
+	MutateExisting bool
+	MutateDryRun   bool
+	MutateRate     int
+	MutateInterval time.Duration
+	// GenerateSync applies objects generated by jsa_generate on updates, and GenerateDelete deletes them with their trigger object
+	GenerateSync   bool
+	GenerateDelete bool
+	// CleanupSchedule is the schedule of deletions of objects selected by jsa_cleanup, up to CleanupMax per run, or nil to disable them
+	CleanupSchedule *cron.Schedule
+	CleanupDryRun   bool
+	CleanupMax      int
+	// Schedules are functions called with read-write state at each time of their cron schedule
+	Schedules []scheduleSpec
+}
+
+// scheduleSpec is an item of spec.schedules, calling Function at each time of Schedule.
+type scheduleSpec struct {
+	Expr     string
+	Schedule *cron.Schedule
+	Function string
+}
+
+// parseAdmissionSpec parses the spec of an admission, returning an error if it is invalid.
+func parseAdmissionSpec(obj *unstructured.Unstructured) (*admissionSpec, error) {
+	content := obj.UnstructuredContent()
+	spec := &admissionSpec{}
+	spec.Js, _, _ = unstructured.NestedString(content, "spec", "js")
+	spec.Kinds, _, _ = unstructured.NestedStringSlice(content, "spec", "kinds")
+	timeoutMillis, hasTimeout, _ := unstructured.NestedInt64(content, "spec", "timeout")
+	spec.Persist, _, _ = unstructured.NestedBool(content, "spec", "state", "persist")
+	spec.Backend, _, _ = unstructured.NestedString(content, "spec", "state", "backend")
+	spec.LeaderOnly, _, _ = unstructured.NestedBool(content, "spec", "events", "leaderOnly")
+	spec.StripPaths, _, _ = unstructured.NestedStringSlice(content, "spec", "cache", "stripPaths")
+	spec.MetadataOnly, _, _ = unstructured.NestedBool(content, "spec", "cache", "metadataOnly")
+	objectSelector, hasObjectSelector, _ := unstructured.NestedMap(content, "spec", "objectSelector")
+	fieldSelector, _, _ := unstructured.NestedString(content, "spec", "fieldSelector")
+	indexList, _, _ := unstructured.NestedSlice(content, "spec", "indexes")
+	resyncInterval, _, _ := unstructured.NestedString(content, "spec", "resync")
+	backgroundInterval, _, _ := unstructured.NestedString(content, "spec", "background", "interval")
+	spec.MutateExisting, _, _ = unstructured.NestedBool(content, "spec", "mutateExisting", "enabled")
+	spec.MutateDryRun, _, _ = unstructured.NestedBool(content, "spec", "mutateExisting", "dryRun")
+	mutateRate, hasMutateRate, _ := unstructured.NestedInt64(content, "spec", "mutateExisting", "rate")
+	mutateInterval, _, _ := unstructured.NestedString(content, "spec", "mutateExisting", "interval")
+	spec.GenerateSync, _, _ = unstructured.NestedBool(content, "spec", "generate", "synchronize")
+	spec.GenerateDelete, _, _ = unstructured.NestedBool(content, "spec", "generate", "deleteWithTrigger")
+	cleanupSchedule, _, _ := unstructured.NestedString(content, "spec", "cleanup", "schedule")
+	spec.CleanupDryRun, _, _ = unstructured.NestedBool(content, "spec", "cleanup", "dryRun")
+	cleanupMax, hasCleanupMax, _ := unstructured.NestedInt64(content, "spec", "cleanup", "maxDeletions")
+	scheduleList, _, _ := unstructured.NestedSlice(content, "spec", "schedules")
+
+	// parse timeout in milliseconds
+	if hasTimeout {
+		if timeoutMillis <= 0 {
+			return nil, fmt.Errorf("invalid timeout %d", timeoutMillis)
+		}
+		spec.Timeout = time.Duration(timeoutMillis) * time.Millisecond
+	}
+
+	// events update shared state once on the leader, instead of once per replica
+	if spec.Backend == "kubernetes" {
+		spec.LeaderOnly = true
+	}
+
+	// parse selectors, only watching matching objects
+	if hasObjectSelector {
+		selector := &metav1.LabelSelector{}
+		err := runtime.DefaultUnstructuredConverter.FromUnstructured(objectSelector, selector)
+		if err == nil {
+			spec.LabelSelector, err = metav1.LabelSelectorAsSelector(selector)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid objectSelector: %v", err)
+		}
+	}
+	if fieldSelector != "" {
+		var err error
+		spec.FieldSelector, err = fields.ParseSelector(fieldSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fieldSelector: %v", err)
+		}
+	}
+
+	// parse indexes
+	spec.Indexes = make([]admission.Index, 0)
+	for _, item := range indexList {
+		index := admission.Index{}
+		if m, ok := item.(map[string]interface{}); ok {
+			index.Name, _, _ = unstructured.NestedString(m, "name")
+			index.Path, _, _ = unstructured.NestedString(m, "path")
+			index.Function, _, _ = unstructured.NestedString(m, "function")
+		}
+		if index.Name == "" || (index.Path == "") == (index.Function == "") {
+			return nil, fmt.Errorf("invalid index %v, name and either path or function are required", item)
+		}
+		if index.Path != "" && !strings.HasPrefix(index.Path, "/") {
+			return nil, fmt.Errorf("invalid index %v, path must be a JSON pointer like /spec/nodeName", item)
+		}
+		spec.Indexes = append(spec.Indexes, index)
+	}
+
+	// parse resync interval
+	if resyncInterval != "" {
+		var err error
+		spec.Resync, err = time.ParseDuration(resyncInterval)
+		if err != nil || spec.Resync <= 0 {
+			return nil, fmt.Errorf("invalid resync %s", resyncInterval)
+		}
+	}
+
+	// parse background scan interval
+	if backgroundInterval != "" {
+		var err error
+		spec.Background, err = time.ParseDuration(backgroundInterval)
+		if err != nil || spec.Background <= 0 {
+			return nil, fmt.Errorf("invalid background.interval %s", backgroundInterval)
+		}
+	}
+
+	// parse mutate existing options
+	spec.MutateRate = 5
+	if hasMutateRate {
+		if mutateRate <= 0 {
+			return nil, fmt.Errorf("invalid mutateExisting.rate %d", mutateRate)
+		}
+		spec.MutateRate = int(mutateRate)
+	}
+	if mutateInterval != "" {
+		var err error
+		spec.MutateInterval, err = time.ParseDuration(mutateInterval)
+		if err != nil || spec.MutateInterval <= 0 {
+			return nil, fmt.Errorf("invalid mutateExisting.interval %s", mutateInterval)
+		}
+	}
+
+	// parse cleanup options
+	if cleanupSchedule != "" {
+		var err error
+		spec.CleanupSchedule, err = cron.Parse(cleanupSchedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cleanup.schedule: %v", err)
+		}
+	}
+	spec.CleanupMax = 100
+	if hasCleanupMax {
+		if cleanupMax <= 0 {
+			return nil, fmt.Errorf("invalid cleanup.maxDeletions %d", cleanupMax)
+		}
+		spec.CleanupMax = int(cleanupMax)
+	}
+
+	// parse schedules, functions being unique as status is reported by function
+	spec.Schedules = make([]scheduleSpec, 0)
+	functions := make(map[string]bool)
+	for _, item := range scheduleList {
+		schedule := scheduleSpec{}
+		if m, ok := item.(map[string]interface{}); ok {
+			schedule.Expr, _, _ = unstructured.NestedString(m, "schedule")
+			schedule.Function, _, _ = unstructured.NestedString(m, "function")
+		}
+		if schedule.Function == "" {
+			schedule.Function = admission.JsaCron
+		}
+		var err error
+		schedule.Schedule, err = cron.Parse(schedule.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedules.schedule: %v", err)
+		}
+		if functions[schedule.Function] {
+			return nil, fmt.Errorf("invalid schedules, function %s is scheduled twice", schedule.Function)
+		}
+		functions[schedule.Function] = true
+		spec.Schedules = append(spec.Schedules, schedule)
+	}
+
+	return spec, nil
+}
+
+// checkSharedState returns an error if the spec uses a shared state without leader election,
+// as all replicas would then apply events to the same state, counting each object once per replica.
+func (s *admissionSpec) checkSharedState(leaderElection bool) error {
+	if s.Backend == "kubernetes" && !leaderElection {
+		return fmt.Errorf("spec.state.backend kubernetes requires --leaderElection, so events only update the shared state on the leader")
+	}
+	return nil
+}
+
+// jsTimeout returns the execution timeout of javascript code, spec.timeout or --timeout, or the default timeout if none is set.
+func (s *admissionSpec) jsTimeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	if timeout > 0 {
+		return time.Duration(timeout) * time.Second
+	}
+	return admission.DefaultTimeout
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestParseTimeout(t *testing.T) {
+	obj := newLintAdmission([]interface{}{"pods"}, "function jsa_validate(op, obj) {}")
+
+	// default to --timeout in seconds, or to the default timeout if not set
+	defer func(value int) { timeout = value }(timeout)
+	timeout = 0
+	spec, err := parseAdmissionSpec(obj)
+	if err != nil || spec.jsTimeout() != 10*time.Second {
+		t.Fatalf("failed")
+	}
+	timeout = 3
+	if spec.jsTimeout() != 3*time.Second {
+		t.Fatalf("failed")
+	}
+
+	// spec.timeout in milliseconds
+	_ = unstructured.SetNestedField(obj.Object, int64(250), "spec", "timeout")
+	spec, err = parseAdmissionSpec(obj)
+	if err != nil || spec.jsTimeout() != 250*time.Millisecond {
+		t.Fatalf("failed")
+	}
+	_ = unstructured.SetNestedField(obj.Object, int64(0), "spec", "timeout")
+	if _, err = parseAdmissionSpec(obj); err == nil {
+		t.Fatalf("failed")
+	}
+}
+
+func TestParseSharedState(t *testing.T) {
+	obj := newLintAdmission([]interface{}{"pods"}, "function jsa_validate(op, obj) {}")
+
+	// shared state forces events on the leader only
+	_ = unstructured.SetNestedField(obj.Object, "kubernetes", "spec", "state", "backend")
+	spec, err := parseAdmissionSpec(obj)
+	if err != nil || !spec.LeaderOnly {
+		t.Fatalf("failed")
+	}
+
+	// shared state requires leader election, as all replicas would apply events
+	if spec.checkSharedState(false) == nil || spec.checkSharedState(true) != nil {
+		t.Fatalf("failed")
+	}
+	_ = unstructured.SetNestedField(obj.Object, "memory", "spec", "state", "backend")
+	spec, _ = parseAdmissionSpec(obj)
+	if spec.checkSharedState(false) != nil {
+		t.Fatalf("failed")
+	}
+}
+
+func TestParseIndexes(t *testing.T) {
+	obj := newLintAdmission([]interface{}{"pods"}, "function jsa_validate(op, obj) {}")
+
+	// index paths are JSON pointers
+	_ = unstructured.SetNestedSlice(obj.Object, []interface{}{map[string]interface{}{"name": "node", "path": "/spec/nodeName"}}, "spec", "indexes")
+	spec, err := parseAdmissionSpec(obj)
+	if err != nil || len(spec.Indexes) != 1 || spec.Indexes[0].Path != "/spec/nodeName" {
+		t.Fatalf("failed")
+	}
+	_ = unstructured.SetNestedSlice(obj.Object, []interface{}{map[string]interface{}{"name": "node", "path": "spec.nodeName"}}, "spec", "indexes")
+	if _, err = parseAdmissionSpec(obj); err == nil {
+		t.Fatalf("failed")
+	}
+}
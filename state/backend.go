@@ -0,0 +1,177 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/logs"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	MaxRetries     = 10
+	RequestTimeout = 10 * time.Second
+)
+
+// KubernetesBackend stores the state in a ConfigMap, shared by all replicas of the controller.
+//
+// Updates use optimistic concurrency on the ConfigMap resourceVersion:
+// the ConfigMap is always read before calling the update function, so decisions are made on the current state,
+// and the function is called again with the latest state if the ConfigMap has been modified in between.
+// The ConfigMap is only written when the state has changed.
+type KubernetesBackend struct {
+	mux       sync.RWMutex
+	client    dynamic.Interface
+	namespace string
+	name      string
+	owner     metav1.OwnerReference
+	maxSize   int
+	state     map[string]interface{}
+}
+
+func NewKubernetesBackend(client dynamic.Interface, namespace string, name string, owner metav1.OwnerReference, maxSize int) *KubernetesBackend {
+	return &KubernetesBackend{
+		mux:       sync.RWMutex{},
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		owner:     owner,
+		maxSize:   maxSize,
+		state:     make(map[string]interface{}),
+	}
+}
+
+// Load reads the state from the ConfigMap, and returns false if there is none.
+func (b *KubernetesBackend) Load() (bool, error) {
+	state, version, err := b.fetch()
+	if err != nil {
+		return false, err
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.state = state
+	return version != "", nil
+}
+
+// Get returns the last known state, without reading the ConfigMap.
+func (b *KubernetesBackend) Get() map[string]interface{} {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.state
+}
+
+func (b *KubernetesBackend) Set(state map[string]interface{}) error {
+	return b.Update(func(map[string]interface{}) (map[string]interface{}, error) {
+		return state, nil
+	})
+}
+
+func (b *KubernetesBackend) Update(fn func(state map[string]interface{}) (map[string]interface{}, error)) error {
+	for retry := 0; retry < MaxRetries; retry++ {
+		// read latest state
+		cm, err := b.get()
+		if err != nil {
+			return err
+		}
+		data, _, _ := unstructured.NestedString(cm.Object, "data", DataKey)
+		state, err := b.decode(data)
+		if err != nil {
+			return err
+		}
+
+		// compute new state
+		state, err = fn(state)
+		if err != nil {
+			return err
+		}
+		newData, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		if b.maxSize > 0 && len(newData) > b.maxSize {
+			return fmt.Errorf("state is too large: %d bytes, max is %d bytes", len(newData), b.maxSize)
+		}
+
+		// write new state if changed, failing if configmap has been modified in between
+		if string(newData) != data || cm.GetResourceVersion() == "" {
+			err = b.put(cm, string(newData))
+			if errors.IsConflict(err) || errors.IsAlreadyExists(err) {
+				logs.Tracef("State: conflict on %s/%s, retrying", b.namespace, b.name)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		b.mux.Lock()
+		b.state = state
+		b.mux.Unlock()
+		return nil
+	}
+	return fmt.Errorf("failed to update state %s/%s after %d retries", b.namespace, b.name, MaxRetries)
+}
+
+func (b *KubernetesBackend) fetch() (map[string]interface{}, string, error) {
+	cm, err := b.get()
+	if err != nil {
+		return nil, "", err
+	}
+	data, _, _ := unstructured.NestedString(cm.Object, "data", DataKey)
+	state, err := b.decode(data)
+	if err != nil {
+		return nil, "", err
+	}
+	return state, cm.GetResourceVersion(), nil
+}
+
+// get returns the configmap, or a new one without resourceVersion if it does not exist.
+func (b *KubernetesBackend) get() (*unstructured.Unstructured, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+	cm, err := b.client.Resource(ConfigMapGVR).Namespace(b.namespace).Get(ctx, b.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		cm = &unstructured.Unstructured{}
+		cm.SetAPIVersion("v1")
+		cm.SetKind("ConfigMap")
+		cm.SetNamespace(b.namespace)
+		cm.SetName(b.name)
+		cm.SetLabels(map[string]string{Label: "true"})
+		cm.SetOwnerReferences([]metav1.OwnerReference{b.owner})
+		return cm, nil
+	}
+	return cm, err
+}
+
+// put creates or updates the configmap, using resourceVersion for optimistic concurrency.
+func (b *KubernetesBackend) put(cm *unstructured.Unstructured, data string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	defer cancel()
+	_ = unstructured.SetNestedField(cm.Object, data, "data", DataKey)
+	client := b.client.Resource(ConfigMapGVR).Namespace(b.namespace)
+	var err error
+	if cm.GetResourceVersion() == "" {
+		_, err = client.Create(ctx, cm, metav1.CreateOptions{})
+	} else {
+		_, err = client.Update(ctx, cm, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+func (b *KubernetesBackend) decode(data string) (map[string]interface{}, error) {
+	state := make(map[string]interface{})
+	if data == "" {
+		return state, nil
+	}
+	err := json.Unmarshal([]byte(data), &state)
+	if err != nil {
+		return nil, fmt.Errorf("invalid state in configmap %s/%s: %v", b.namespace, b.name, err)
+	}
+	return state, nil
+}
@@ -0,0 +1,110 @@
+package state
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newVersionedClient returns a fake client checking and incrementing resourceVersion on configmaps, like the api server.
+func newVersionedClient() *fake.FakeDynamicClient {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	mux := sync.Mutex{}
+	client.PrependReactor("create", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		obj := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		obj.SetResourceVersion("1")
+		err := client.Tracker().Create(ConfigMapGVR, obj, obj.GetNamespace())
+		return true, obj, err
+	})
+	client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		obj := action.(k8stesting.UpdateAction).GetObject().(*unstructured.Unstructured)
+		current, err := client.Tracker().Get(ConfigMapGVR, obj.GetNamespace(), obj.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		version := current.(*unstructured.Unstructured).GetResourceVersion()
+		if version != obj.GetResourceVersion() {
+			return true, nil, errors.NewConflict(ConfigMapGVR.GroupResource(), obj.GetName(), nil)
+		}
+		v, _ := strconv.Atoi(version)
+		obj.SetResourceVersion(strconv.Itoa(v + 1))
+		err = client.Tracker().Update(ConfigMapGVR, obj, obj.GetNamespace())
+		return true, obj, err
+	})
+	return client
+}
+
+func TestKubernetesBackend_Update(t *testing.T) {
+	client := newVersionedClient()
+
+	// test no state
+	b1 := NewKubernetesBackend(client, "ns", "cm", metav1.OwnerReference{Name: "a"}, 0)
+	found, err := b1.Load()
+	if err != nil || found {
+		t.Fatalf("failed")
+	}
+
+	// two replicas sharing the same configmap
+	b2 := NewKubernetesBackend(client, "ns", "cm", metav1.OwnerReference{Name: "a"}, 0)
+	increment := func(state map[string]interface{}) (map[string]interface{}, error) {
+		count, _ := state["count"].(float64)
+		return map[string]interface{}{"count": count + 1}, nil
+	}
+
+	// test concurrent increments are not lost
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		for _, b := range []*KubernetesBackend{b1, b2} {
+			wg.Add(1)
+			go func(b *KubernetesBackend) {
+				defer wg.Done()
+				for {
+					err := b.Update(increment)
+					if err == nil {
+						return
+					}
+				}
+			}(b)
+		}
+	}
+	wg.Wait()
+	found, err = b1.Load()
+	if err != nil || !found || b1.Get()["count"] != float64(10) {
+		t.Fatalf("failed")
+	}
+
+	// test unchanged state is not written
+	cm, _ := client.Resource(ConfigMapGVR).Namespace("ns").Get(context.Background(), "cm", metav1.GetOptions{})
+	client.ClearActions()
+	err = b1.Update(func(state map[string]interface{}) (map[string]interface{}, error) { return state, nil })
+	cm2, _ := client.Resource(ConfigMapGVR).Namespace("ns").Get(context.Background(), "cm", metav1.GetOptions{})
+	if err != nil || cm.GetResourceVersion() != cm2.GetResourceVersion() || b1.Get()["count"] != float64(10) || len(client.Actions()) != 2 {
+		t.Fatalf("failed")
+	}
+
+	// test a replica sees the update of the other replica immediately
+	err = b1.Update(increment)
+	if err != nil {
+		t.Fatalf("failed")
+	}
+	var seen interface{}
+	err = b2.Update(func(state map[string]interface{}) (map[string]interface{}, error) {
+		seen = state["count"]
+		return state, nil
+	})
+	if err != nil || seen != float64(11) || b2.Get()["count"] != float64(11) {
+		t.Fatalf("failed")
+	}
+}
@@ -0,0 +1,142 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/momiji/js-admissions-controller/logs"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	DataKey = "state.json"
+	Label   = "jsadmissions.momiji.com/state"
+)
+
+var (
+	ConfigMapGVR = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "configmaps"}
+)
+
+// Snapshot is the state of an admission to persist.
+type Snapshot struct {
+	Namespace string
+	Name      string
+	Owner     metav1.OwnerReference
+	State     map[string]interface{}
+}
+
+// Persister saves and restores admission states into ConfigMaps owned by the admissions.
+//
+// ConfigMaps of namespace admissions are stored in the admission namespace,
+// while ConfigMaps of cluster admissions are stored in the controller namespace.
+type Persister struct {
+	mux       sync.Mutex
+	client    dynamic.Interface
+	namespace string
+	maxSize   int
+	saved     map[string]string
+}
+
+func NewPersister(client dynamic.Interface, namespace string, maxSize int) *Persister {
+	return &Persister{
+		mux:       sync.Mutex{},
+		client:    client,
+		namespace: namespace,
+		maxSize:   maxSize,
+		saved:     make(map[string]string),
+	}
+}
+
+// ObjectKey returns the namespace and name of the ConfigMap used to store the state of an admission.
+func (p *Persister) ObjectKey(namespace string, name string) (string, string) {
+	if namespace == "" {
+		return p.namespace, "clusterjsadmission-state-" + name
+	}
+	return namespace, "jsadmission-state-" + name
+}
+
+// Load returns the persisted state of an admission, and false if there is none.
+func (p *Persister) Load(ctx context.Context, namespace string, name string) (map[string]interface{}, bool, error) {
+	cmNamespace, cmName := p.ObjectKey(namespace, name)
+	cm, err := p.client.Resource(ConfigMapGVR).Namespace(cmNamespace).Get(ctx, cmName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	data, found, _ := unstructured.NestedString(cm.Object, "data", DataKey)
+	if !found {
+		return nil, false, nil
+	}
+	state := make(map[string]interface{})
+	err = json.Unmarshal([]byte(data), &state)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid state in configmap %s/%s: %v", cmNamespace, cmName, err)
+	}
+
+	// remember loaded state to prevent saving it again
+	p.mux.Lock()
+	p.saved[cmNamespace+"/"+cmName] = data
+	p.mux.Unlock()
+	return state, true, nil
+}
+
+// Save persists the state of an admission, unless it is unchanged since last save or too large.
+func (p *Persister) Save(ctx context.Context, snapshot *Snapshot) error {
+	cmNamespace, cmName := p.ObjectKey(snapshot.Namespace, snapshot.Name)
+	key := cmNamespace + "/" + cmName
+	b, err := json.Marshal(snapshot.State)
+	if err != nil {
+		return err
+	}
+	data := string(b)
+	if p.maxSize > 0 && len(data) > p.maxSize {
+		return fmt.Errorf("state is too large: %d bytes, max is %d bytes", len(data), p.maxSize)
+	}
+
+	// skip if unchanged
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if saved, ok := p.saved[key]; ok && saved == data {
+		return nil
+	}
+
+	// create or update configmap
+	client := p.client.Resource(ConfigMapGVR).Namespace(cmNamespace)
+	cm, err := client.Get(ctx, cmName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		cm = &unstructured.Unstructured{}
+		cm.SetAPIVersion("v1")
+		cm.SetKind("ConfigMap")
+		cm.SetNamespace(cmNamespace)
+		cm.SetName(cmName)
+		cm.SetLabels(map[string]string{Label: "true"})
+		cm.SetOwnerReferences([]metav1.OwnerReference{snapshot.Owner})
+		_ = unstructured.SetNestedField(cm.Object, data, "data", DataKey)
+		_, err = client.Create(ctx, cm, metav1.CreateOptions{})
+	} else if err == nil {
+		_ = unstructured.SetNestedField(cm.Object, data, "data", DataKey)
+		_, err = client.Update(ctx, cm, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	p.saved[key] = data
+	logs.Tracef("State: saved %s size=%d", key, len(data))
+	return nil
+}
+
+// Forget removes the last saved state from memory, so next save is not skipped.
+func (p *Persister) Forget(namespace string, name string) {
+	cmNamespace, cmName := p.ObjectKey(namespace, name)
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	delete(p.saved, cmNamespace+"/"+cmName)
+}
@@ -0,0 +1,55 @@
+package state
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func TestPersister_SaveLoad(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	p := NewPersister(client, "controller", 100)
+
+	// test no state
+	_, found, err := p.Load(ctx, "ns", "a")
+	if err != nil || found {
+		t.Fatalf("failed")
+	}
+
+	// test save and load, for namespace and cluster admissions
+	for _, ns := range []string{"ns", ""} {
+		err = p.Save(ctx, &Snapshot{Namespace: ns, Name: "a", Owner: metav1.OwnerReference{Name: "a"}, State: map[string]interface{}{"count": 1}})
+		if err != nil {
+			t.Fatalf("failed")
+		}
+		err = p.Save(ctx, &Snapshot{Namespace: ns, Name: "a", Owner: metav1.OwnerReference{Name: "a"}, State: map[string]interface{}{"count": 2}})
+		if err != nil {
+			t.Fatalf("failed")
+		}
+		state, found, err := p.Load(ctx, ns, "a")
+		if err != nil || !found || state["count"] != float64(2) {
+			t.Fatalf("failed")
+		}
+	}
+
+	// test configmaps location and owner
+	cm, err := client.Resource(ConfigMapGVR).Namespace("controller").Get(ctx, "clusterjsadmission-state-a", metav1.GetOptions{})
+	if err != nil || len(cm.GetOwnerReferences()) != 1 || cm.GetOwnerReferences()[0].Name != "a" {
+		t.Fatalf("failed")
+	}
+	_, err = client.Resource(ConfigMapGVR).Namespace("ns").Get(ctx, "jsadmission-state-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed")
+	}
+
+	// test size limit
+	err = p.Save(ctx, &Snapshot{Namespace: "ns", Name: "a", State: map[string]interface{}{"data": strings.Repeat("x", 100)}})
+	if err == nil {
+		t.Fatalf("failed")
+	}
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"fmt"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"sync"
 )
@@ -8,11 +9,16 @@ import (
 type Cache struct {
 	mux sync.RWMutex
 	GVK map[string]*CacheGVK
+	// indexers are the indexers of each key, in addition to default indexers used for all keys
+	indexers map[string]map[string]IndexFunc
+	defaults map[string]IndexFunc
 }
 
 type CacheGVK struct {
 	Key        string
 	Namespaces map[string]*CacheNamespace
+	// Indices are the items by index name, index value, and namespace/name
+	Indices map[string]map[string]map[string]*CacheItem
 }
 
 type CacheNamespace struct {
@@ -22,16 +28,26 @@ type CacheNamespace struct {
 
 type CacheItem struct {
 	Obj *unstructured.Unstructured
+	// Index are the values of the item by index name
+	Index map[string][]string
 }
 
 func NewCache() *Cache {
 	return &Cache{
-		mux: sync.RWMutex{},
-		GVK: make(map[string]*CacheGVK),
+		mux:      sync.RWMutex{},
+		GVK:      make(map[string]*CacheGVK),
+		indexers: make(map[string]map[string]IndexFunc),
+		defaults: map[string]IndexFunc{
+			LabelIndex: IndexByLabel,
+			OwnerIndex: IndexByOwner,
+		},
 	}
 }
 
 func (c *Cache) Add(key string, namespace string, name string, obj *unstructured.Unstructured) {
+	// compute index values without lock, as index functions may call javascript code doing lookups
+	index := c.indexValues(c.getIndexers(key), obj)
+
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
@@ -47,7 +63,13 @@ func (c *Cache) Add(key string, namespace string, name string, obj *unstructured
 		gvk.Namespaces[namespace] = ns
 	}
 
-	ns.Names[name] = c.newItem(obj)
+	if old, ok := ns.Names[name]; ok {
+		c.unindex(gvk, namespace, name, old)
+	}
+	item := c.newItem(obj)
+	item.Index = index
+	ns.Names[name] = item
+	c.index(gvk, namespace, name, item)
 }
 
 func (c *Cache) Remove(key string, namespace string, name string) {
@@ -64,9 +86,42 @@ func (c *Cache) Remove(key string, namespace string, name string) {
 		return
 	}
 
+	if old, ok := ns.Names[name]; ok {
+		c.unindex(gvk, namespace, name, old)
+	}
 	delete(ns.Names, name)
 }
 
+// Purge removes all items with this key.
+func (c *Cache) Purge(key string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	delete(c.GVK, key)
+}
+
+// Get returns the item, or nil if it is not in cache.
+func (c *Cache) Get(key string, namespace string, name string) *unstructured.Unstructured {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	gvk, ok := c.GVK[key]
+	if !ok {
+		return nil
+	}
+
+	ns, ok := gvk.Namespaces[namespace]
+	if !ok {
+		return nil
+	}
+
+	item, ok := ns.Names[name]
+	if !ok {
+		return nil
+	}
+	return item.Obj
+}
+
 func (c *Cache) Find(key string, namespace string) []*unstructured.Unstructured {
 	c.mux.RLock()
 	defer c.mux.RUnlock()
@@ -88,10 +143,163 @@ func (c *Cache) Find(key string, namespace string) []*unstructured.Unstructured
 	return res
 }
 
+// AddIndexer adds or replaces an index of the key, and indexes all items already in cache.
+//
+// Items must not be added or removed for this key until it returns, as they are indexed without lock.
+func (c *Cache) AddIndexer(key string, name string, indexer IndexFunc) {
+	// compute index values without lock
+	type indexed struct {
+		item   *CacheItem
+		values []string
+	}
+	c.mux.RLock()
+	items := make(map[string]*indexed)
+	if gvk, ok := c.GVK[key]; ok {
+		for _, ns := range gvk.Namespaces {
+			for itemName, item := range ns.Names {
+				items[ns.Namespace+"/"+itemName] = &indexed{item: item}
+			}
+		}
+	}
+	c.mux.RUnlock()
+	for _, i := range items {
+		i.values = indexer(i.item.Obj)
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if _, ok := c.indexers[key]; !ok {
+		c.indexers[key] = make(map[string]IndexFunc)
+	}
+	c.indexers[key][name] = indexer
+	gvk, ok := c.GVK[key]
+	if !ok {
+		return
+	}
+	index := make(map[string]map[string]*CacheItem)
+	gvk.Indices[name] = index
+	for itemKey, i := range items {
+		i.item.Index[name] = i.values
+		for _, value := range i.values {
+			if _, ok := index[value]; !ok {
+				index[value] = make(map[string]*CacheItem)
+			}
+			index[value][itemKey] = i.item
+		}
+	}
+}
+
+// RemoveIndexer removes an index of the key, default indexes are never removed.
+func (c *Cache) RemoveIndexer(key string, name string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if _, ok := c.defaults[name]; ok {
+		return
+	}
+	delete(c.indexers[key], name)
+	if len(c.indexers[key]) == 0 {
+		delete(c.indexers, key)
+	}
+	gvk, ok := c.GVK[key]
+	if !ok {
+		return
+	}
+	delete(gvk.Indices, name)
+	for _, ns := range gvk.Namespaces {
+		for _, item := range ns.Names {
+			delete(item.Index, name)
+		}
+	}
+}
+
+// ByIndex returns copies of items with the same namespace, or for all namespaces if namespace="", having this value in the index.
+//
+// If index is empty, all items are returned.
+func (c *Cache) ByIndex(key string, namespace string, index string, value string) ([]*unstructured.Unstructured, error) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	_, isDefault := c.defaults[index]
+	_, isIndexer := c.indexers[key][index]
+	if index != "" && !isDefault && !isIndexer {
+		return nil, fmt.Errorf("unknown index %s for %s", index, key)
+	}
+
+	gvk, ok := c.GVK[key]
+	if !ok {
+		return []*unstructured.Unstructured{}, nil
+	}
+
+	res := make([]*unstructured.Unstructured, 0)
+	if index == "" {
+		for _, ns := range gvk.Namespaces {
+			if namespace == "" || namespace == ns.Namespace {
+				for _, item := range ns.Names {
+					res = append(res, item.Obj.DeepCopy())
+				}
+			}
+		}
+		return res, nil
+	}
+	for _, item := range gvk.Indices[index][value] {
+		if namespace == "" || namespace == item.Obj.GetNamespace() {
+			res = append(res, item.Obj.DeepCopy())
+		}
+	}
+	return res, nil
+}
+
+func (c *Cache) getIndexers(key string) map[string]IndexFunc {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	indexers := make(map[string]IndexFunc)
+	for name, indexer := range c.defaults {
+		indexers[name] = indexer
+	}
+	for name, indexer := range c.indexers[key] {
+		indexers[name] = indexer
+	}
+	return indexers
+}
+
+func (c *Cache) indexValues(indexers map[string]IndexFunc, obj *unstructured.Unstructured) map[string][]string {
+	index := make(map[string][]string)
+	for name, indexer := range indexers {
+		index[name] = indexer(obj)
+	}
+	return index
+}
+
+func (c *Cache) index(gvk *CacheGVK, namespace string, name string, item *CacheItem) {
+	for index, values := range item.Index {
+		if _, ok := gvk.Indices[index]; !ok {
+			gvk.Indices[index] = make(map[string]map[string]*CacheItem)
+		}
+		for _, value := range values {
+			if _, ok := gvk.Indices[index][value]; !ok {
+				gvk.Indices[index][value] = make(map[string]*CacheItem)
+			}
+			gvk.Indices[index][value][namespace+"/"+name] = item
+		}
+	}
+}
+
+func (c *Cache) unindex(gvk *CacheGVK, namespace string, name string, item *CacheItem) {
+	for index, values := range item.Index {
+		for _, value := range values {
+			delete(gvk.Indices[index][value], namespace+"/"+name)
+			if len(gvk.Indices[index][value]) == 0 {
+				delete(gvk.Indices[index], value)
+			}
+		}
+	}
+}
+
 func (c *Cache) newGVK(key string) *CacheGVK {
 	return &CacheGVK{
 		Key:        key,
 		Namespaces: make(map[string]*CacheNamespace),
+		Indices:    make(map[string]map[string]map[string]*CacheItem),
 	}
 }
 
@@ -103,5 +311,5 @@ func (c *Cache) newNamespace(namespace string) *CacheNamespace {
 }
 
 func (c *Cache) newItem(obj *unstructured.Unstructured) *CacheItem {
-	return &CacheItem{obj}
+	return &CacheItem{Obj: obj, Index: make(map[string][]string)}
 }
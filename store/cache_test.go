@@ -62,3 +62,103 @@ func TestCache_Find(t *testing.T) {
 		t.Fatalf("failed")
 	}
 }
+
+func TestCache_Purge(t *testing.T) {
+	cache := NewCache()
+
+	cache.Add("a", "ns1", "a1", &unstructured.Unstructured{})
+	cache.Add("b", "ns1", "b1", &unstructured.Unstructured{})
+
+	// check Purge only removes items with the same key
+	cache.Purge("a")
+	if len(cache.Find("a", "")) != 0 || cache.Get("a", "ns1", "a1") != nil {
+		t.Fatalf("failed")
+	}
+	if len(cache.Find("b", "")) != 1 || cache.Get("b", "ns1", "b1") == nil {
+		t.Fatalf("failed")
+	}
+}
+
+func TestCache_Index(t *testing.T) {
+	cache := NewCache()
+	newItem := func(name string, node string, labels map[string]string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{"nodeName": node}}}
+		obj.SetNamespace("ns1")
+		obj.SetName(name)
+		obj.SetLabels(labels)
+		return obj
+	}
+	cache.Add("a", "ns1", "a1", newItem("a1", "node1", map[string]string{"app": "x"}))
+	cache.Add("a", "ns1", "a2", newItem("a2", "node2", map[string]string{"app": "x", "tier": "web"}))
+
+	// check default label index
+	res, err := cache.ByIndex("a", "", LabelIndex, "app=x")
+	if err != nil || len(res) != 2 {
+		t.Fatalf("failed")
+	}
+	res, err = cache.ByIndex("a", "ns2", LabelIndex, "app=x")
+	if err != nil || len(res) != 0 {
+		t.Fatalf("failed")
+	}
+
+	// check unknown index
+	if _, err = cache.ByIndex("a", "", "node", "node1"); err == nil {
+		t.Fatalf("failed")
+	}
+
+	// check index added after items, and updated with items
+	cache.AddIndexer("a", "node", IndexByPath("/spec/nodeName"))
+	res, err = cache.ByIndex("a", "", "node", "node1")
+	if err != nil || len(res) != 1 || res[0].GetName() != "a1" {
+		t.Fatalf("failed")
+	}
+	cache.Add("a", "ns1", "a1", newItem("a1", "node2", nil))
+	res, _ = cache.ByIndex("a", "", "node", "node2")
+	if len(res) != 2 {
+		t.Fatalf("failed")
+	}
+	res, _ = cache.ByIndex("a", "", LabelIndex, "app=x")
+	if len(res) != 1 {
+		t.Fatalf("failed")
+	}
+	cache.Remove("a", "ns1", "a2")
+	res, _ = cache.ByIndex("a", "", "node", "node2")
+	if len(res) != 1 || len(cache.GVK["a"].Indices["node"]["node2"]) != 1 {
+		t.Fatalf("failed")
+	}
+
+	// check returned items are copies
+	res[0].SetName("changed")
+	if cache.Get("a", "ns1", "a1").GetName() != "a1" {
+		t.Fatalf("failed")
+	}
+
+	// check index is removed, and all items are returned without index
+	cache.RemoveIndexer("a", "node")
+	if _, err = cache.ByIndex("a", "", "node", "node2"); err == nil {
+		t.Fatalf("failed")
+	}
+	res, err = cache.ByIndex("a", "", "", "")
+	if err != nil || len(res) != 1 {
+		t.Fatalf("failed")
+	}
+}
+
+func TestCache_IndexValues(t *testing.T) {
+	values := IndexValues([]interface{}{"a", int64(1), true, nil, map[string]interface{}{}, []interface{}{"b"}})
+	if len(values) != 4 || values[0] != "a" || values[1] != "1" || values[2] != "true" || values[3] != "b" {
+		t.Fatalf("failed")
+	}
+}
+
+func TestCache_IndexByPath(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{"nodeName": "node1"}}}
+	obj.SetAnnotations(map[string]string{"example.com/zone": "z1"})
+	if values := IndexByPath("/spec/nodeName")(obj); len(values) != 1 || values[0] != "node1" {
+		t.Fatalf("failed")
+	}
+	// keys with dots or escaped slashes
+	if values := IndexByPath("/metadata/annotations/example.com~1zone")(obj); len(values) != 1 || values[0] != "z1" {
+		t.Fatalf("failed")
+	}
+}
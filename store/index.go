@@ -0,0 +1,76 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// LabelIndex indexes objects by label, with values "key=value"
+	LabelIndex = "label"
+	// OwnerIndex indexes objects by uid of their owners
+	OwnerIndex = "owner"
+)
+
+// IndexFunc returns the values of an object in an index.
+type IndexFunc func(obj *unstructured.Unstructured) []string
+
+// IndexByLabel returns the labels of an object, as "key=value".
+func IndexByLabel(obj *unstructured.Unstructured) []string {
+	values := make([]string, 0)
+	for key, value := range obj.GetLabels() {
+		values = append(values, key+"="+value)
+	}
+	return values
+}
+
+// IndexByOwner returns the uid of the owners of an object.
+func IndexByOwner(obj *unstructured.Unstructured) []string {
+	values := make([]string, 0)
+	for _, owner := range obj.GetOwnerReferences() {
+		values = append(values, string(owner.UID))
+	}
+	return values
+}
+
+// IndexByPath returns an IndexFunc indexing objects by the value at path, a JSON pointer like /spec/nodeName.
+//
+// Lists of values are indexed by each value, while objects are not indexed.
+func IndexByPath(path string) IndexFunc {
+	fields := ParsePointer(path)
+	return func(obj *unstructured.Unstructured) []string {
+		value, found, _ := unstructured.NestedFieldNoCopy(obj.Object, fields...)
+		if !found {
+			return nil
+		}
+		return IndexValues(value)
+	}
+}
+
+// ParsePointer parses a JSON pointer into keys, like /metadata/annotations/kubectl.kubernetes.io~1last-applied-configuration
+func ParsePointer(pointer string) []string {
+	keys := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, key := range keys {
+		keys[i] = strings.ReplaceAll(strings.ReplaceAll(key, "~1", "/"), "~0", "~")
+	}
+	return keys
+}
+
+// IndexValues converts a value to index values, like the result of a javascript index function.
+func IndexValues(value interface{}) []string {
+	switch v := value.(type) {
+	case nil, map[string]interface{}:
+		return nil
+	case []interface{}:
+		values := make([]string, 0)
+		for _, item := range v {
+			values = append(values, IndexValues(item)...)
+		}
+		return values
+	case string:
+		return []string{v}
+	}
+	return []string{fmt.Sprint(value)}
+}
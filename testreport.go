@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// testReport is the result of a test of the test command, either a test of a test-suite or a jsa_test_* function.
+type testReport struct {
+	Suite    string
+	Name     string
+	Duration time.Duration
+	// Failures are failed expectations or assertions, and Error an error preventing the test to run
+	Failures []string
+	Error    string
+	// Output is the result of a request, with the JSON patch and the resulting object
+	Output []string
+}
+
+func (r testReport) failed() bool {
+	return len(r.Failures) > 0 || r.Error != ""
+}
+
+// writeReports writes reports in text, TAP or JUnit XML format.
+func writeReports(w io.Writer, format string, quiet bool, reports []testReport) error {
+	switch format {
+	case "tap":
+		return writeTap(w, reports)
+	case "junit":
+		return writeJunit(w, reports)
+	}
+	return writeText(w, quiet, reports)
+}
+
+func writeText(w io.Writer, quiet bool, reports []testReport) error {
+	failed := 0
+	for _, report := range reports {
+		status := "PASS"
+		if report.failed() {
+			status = "FAIL"
+			failed++
+		} else if quiet {
+			continue
+		}
+		fmt.Fprintf(w, "%s %s: %s\n", status, report.Suite, report.Name)
+		if report.Error != "" {
+			fmt.Fprintf(w, "    error: %s\n", report.Error)
+		}
+		for _, line := range append(report.Failures, report.Output...) {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+	}
+	var err error
+	if failed > 0 {
+		_, err = fmt.Fprintf(w, "FAIL: %d failed, %d passed\n", failed, len(reports)-failed)
+	} else {
+		_, err = fmt.Fprintf(w, "PASS: %d passed\n", len(reports))
+	}
+	return err
+}
+
+// writeTap writes reports in TAP version 13, with failures and outputs as YAML diagnostics.
+func writeTap(w io.Writer, reports []testReport) error {
+	fmt.Fprintf(w, "TAP version 13\n1..%d\n", len(reports))
+	for i, report := range reports {
+		status := "ok"
+		if report.failed() {
+			status = "not ok"
+		}
+		fmt.Fprintf(w, "%s %d - %s: %s\n", status, i+1, report.Suite, report.Name)
+		if !report.failed() && len(report.Output) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "  ---\n")
+		if report.Error != "" {
+			fmt.Fprintf(w, "  error: %q\n", report.Error)
+		}
+		if len(report.Failures) > 0 {
+			fmt.Fprintf(w, "  failures:\n")
+			for _, failure := range report.Failures {
+				fmt.Fprintf(w, "    - %q\n", failure)
+			}
+		}
+		if len(report.Output) > 0 {
+			fmt.Fprintf(w, "  output:\n")
+			for _, line := range report.Output {
+				fmt.Fprintf(w, "    - %q\n", line)
+			}
+		}
+		fmt.Fprintf(w, "  ...\n")
+	}
+	return nil
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	SystemOut *junitOutput  `xml:"system-out,omitempty"`
+}
+
+type junitOutput struct {
+	Text string `xml:",cdata"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJunit writes reports in JUnit XML, with a testsuite per test-suite file.
+func writeJunit(w io.Writer, reports []testReport) error {
+	suites := make([]junitTestSuite, 0)
+	index := make(map[string]int)
+	durations := make(map[string]time.Duration)
+	for _, report := range reports {
+		i, ok := index[report.Suite]
+		if !ok {
+			i = len(suites)
+			index[report.Suite] = i
+			suites = append(suites, junitTestSuite{Name: report.Suite})
+		}
+		suite := &suites[i]
+		testCase := junitTestCase{
+			Name:      report.Name,
+			ClassName: report.Suite,
+			Time:      fmt.Sprintf("%.3f", report.Duration.Seconds()),
+		}
+		if len(report.Output) > 0 {
+			testCase.SystemOut = &junitOutput{Text: strings.Join(report.Output, "\n")}
+		}
+		if report.Error != "" {
+			testCase.Error = &junitMessage{Message: report.Error, Text: report.Error}
+			suite.Errors++
+		} else if len(report.Failures) > 0 {
+			testCase.Failure = &junitMessage{Message: report.Failures[0], Text: strings.Join(report.Failures, "\n")}
+			suite.Failures++
+		}
+		suite.Tests++
+		suite.Cases = append(suite.Cases, testCase)
+		durations[report.Suite] += report.Duration
+	}
+	for i := range suites {
+		suites[i].Time = fmt.Sprintf("%.3f", durations[suites[i].Name].Seconds())
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(junitTestSuites{Suites: suites}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/momiji/js-admissions-controller/admission"
+	"github.com/momiji/js-admissions-controller/discovery"
+	"github.com/momiji/js-admissions-controller/store"
+	"github.com/momiji/js-admissions-controller/utils"
+	"github.com/spf13/pflag"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// testSuite is a test-suite file of the test command, with paths relative to the file.
+type testSuite struct {
+	// Admissions are files of JsAdmission and ClusterJsAdmission objects
+	Admissions []string `json:"admissions"`
+	// Objects are files of objects passed to jsa_created on initialization, and available to jsa_lookup
+	Objects []string   `json:"objects"`
+	Tests   []testCase `json:"tests"`
+}
+
+// testCase is a request sent to mutate then validate, using either an AdmissionReview file or an object.
+type testCase struct {
+	Name string `json:"name"`
+	// File is an AdmissionReview file, or an object file
+	File      string                 `json:"file"`
+	Object    map[string]interface{} `json:"object"`
+	OldObject map[string]interface{} `json:"oldObject"`
+	// Operation is CREATE, UPDATE or DELETE, defaults to CREATE
+	Operation string `json:"operation"`
+	// Namespace defaults to the namespace of the object
+	Namespace string     `json:"namespace"`
+	Expect    testExpect `json:"expect"`
+}
+
+// testExpect is the expected result, only checking fields that are set.
+type testExpect struct {
+	Allowed *bool  `json:"allowed"`
+	Message string `json:"message"`
+	// Patch is a list of operations that must all be in the JSON patch, in any order
+	Patch []interface{} `json:"patch"`
+	// Object is a subset of the resulting object
+	Object map[string]interface{} `json:"object"`
+}
+
+// testResult is the result of a test case.
+type testResult struct {
+	Allowed bool
+	Message string
+	Patch   []interface{}
+	Object  map[string]interface{}
+}
+
+// testCommand runs test-suites offline, without cluster, returning the exit code.
+func testCommand(args []string) int {
+	flags := pflag.NewFlagSet("test", pflag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s test [flags] suite.yaml|admissions.yaml...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.IntVar(&timeout, "timeout", DefaultTimeout, "Execution timeout in seconds for javascript code, unless set by spec.timeout")
+	quiet := flags.BoolP("quiet", "q", false, "Only show failed tests, in text format")
+	format := flags.StringP("format", "f", "text", "Output format: text, tap or junit")
+	output := flags.StringP("output", "o", "", "Output file, instead of stdout")
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 || (*format != "text" && *format != "tap" && *format != "junit") {
+		flags.Usage()
+		return 2
+	}
+
+	reports := make([]testReport, 0)
+	for _, file := range flags.Args() {
+		reports = append(reports, runTestSuite(file)...)
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create %s: %v\n", *output, err)
+			return 2
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := writeReports(out, *format, *quiet, reports); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write reports: %v\n", err)
+		return 2
+	}
+	for _, report := range reports {
+		if report.failed() {
+			return 1
+		}
+	}
+	return 0
+}
+
+// readTestSuite reads a test-suite, or a file of admissions which is then a test-suite without objects nor tests, to only run jsa_test_* functions.
+func readTestSuite(file string) (*testSuite, error) {
+	objs, err := readObjects(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objs {
+		if obj.GroupVersionKind().Group == GroupCrd {
+			return &testSuite{Admissions: []string{filepath.Base(file)}}, nil
+		}
+	}
+	suite := &testSuite{}
+	if err = readYaml(file, suite); err != nil {
+		return nil, err
+	}
+	return suite, nil
+}
+
+// runTestSuite loads admissions and objects of a test-suite, then runs its jsa_test_* functions and its tests.
+//
+// Loading errors are reported as a failed test.
+func runTestSuite(file string) []testReport {
+	reports := make([]testReport, 0)
+	failed := func(err error) []testReport {
+		return append(reports, testReport{Suite: file, Name: "load", Error: err.Error()})
+	}
+
+	suite, err := readTestSuite(file)
+	if err != nil {
+		return failed(err)
+	}
+	dir := filepath.Dir(file)
+
+	// load files
+	files := make([]string, 0)
+	for _, name := range suite.Admissions {
+		files = append(files, filepath.Join(dir, name))
+	}
+	admissionObjs, err := readAdmissions(files)
+	if err != nil {
+		return failed(err)
+	}
+	seeds := make([]*unstructured.Unstructured, 0)
+	for _, name := range suite.Objects {
+		objs, err := readObjects(filepath.Join(dir, name))
+		if err != nil {
+			return failed(err)
+		}
+		seeds = append(seeds, objs...)
+	}
+	reviews := make([]*admissionv1.AdmissionReview, len(suite.Tests))
+	for i, test := range suite.Tests {
+		review, err := newTestReview(dir, test)
+		if err != nil {
+			return failed(fmt.Errorf("test %s: %v", test.Name, err))
+		}
+		reviews[i] = review
+	}
+
+	// load admissions, kinds are only known from objects and requests
+	gvks := make([]schema.GroupVersionKind, 0)
+	for _, review := range reviews {
+		gvks = append(gvks, schema.GroupVersionKind(review.Request.Kind))
+	}
+	codes, err := loadOfflineAdmissions(admissionObjs, seeds, gvks)
+	if err != nil {
+		return failed(err)
+	}
+
+	// run javascript tests
+	for _, code := range codes {
+		results, err := code.Context.RunTests()
+		if err != nil {
+			return failed(fmt.Errorf("admission %s: %v", code.Admission.FullName(), err))
+		}
+		for _, result := range results {
+			report := testReport{Suite: file, Name: code.Admission.FullName() + "/" + result.Name, Duration: result.Duration, Error: result.Error}
+			if result.Failure != "" {
+				report.Failures = []string{result.Failure}
+			}
+			reports = append(reports, report)
+		}
+	}
+
+	// run tests
+	for i, test := range suite.Tests {
+		start := time.Now()
+		res := runTestCase(reviews[i])
+		report := testReport{Suite: file, Name: test.Name, Duration: time.Since(start), Failures: test.Expect.check(res)}
+		report.Output = append(report.Output, fmt.Sprintf("allowed: %v", res.Allowed))
+		if res.Message != "" {
+			report.Output = append(report.Output, fmt.Sprintf("message: %s", res.Message))
+		}
+		if res.Patch != nil {
+			report.Output = append(report.Output, fmt.Sprintf("patch: %s", toJson(res.Patch)))
+			report.Output = append(report.Output, fmt.Sprintf("object: %s", toJson(res.Object)))
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// loadOfflineAdmissions loads admissions without cluster, replacing all admissions.
+//
+// Kinds are resolved against the kinds of seed objects and gvks, and seed objects are passed to jsa_created and available to jsa_lookup.
+func loadOfflineAdmissions(objs []*unstructured.Unstructured, seeds []*unstructured.Unstructured, gvks []schema.GroupVersionKind) ([]*admission.AdmissionCode, error) {
+	for _, obj := range seeds {
+		gvks = append(gvks, obj.GroupVersionKind())
+	}
+	offline := discovery.NewStaticDiscovery(gvks)
+
+	// seed objects are cached by GVK, like the watcher
+	cache := store.NewCache()
+	for _, obj := range seeds {
+		cache.Add(utils.GVKToString(obj.GroupVersionKind()), obj.GetNamespace(), obj.GetName(), obj)
+	}
+
+	// close previous admissions, stopping their event workers
+	if admissions != nil {
+		admissions.Close()
+	}
+	admissions = admission.NewAdmissions()
+	codes := make([]*admission.AdmissionCode, 0)
+	for _, obj := range objs {
+		code, err := loadOfflineAdmission(obj, offline, cache)
+		if err != nil {
+			return nil, fmt.Errorf("admission %s: %v", obj.GetName(), err)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// readAdmissions reads JsAdmission and ClusterJsAdmission objects of files, ignoring other objects.
+func readAdmissions(files []string) ([]*unstructured.Unstructured, error) {
+	admissionObjs := make([]*unstructured.Unstructured, 0)
+	for _, file := range files {
+		objs, err := readObjects(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objs {
+			if obj.GroupVersionKind().Group == GroupCrd {
+				admissionObjs = append(admissionObjs, obj)
+			}
+		}
+	}
+	return admissionObjs, nil
+}
+
+// loadOfflineAdmission loads an admission like admissionHandler, except kinds are resolved offline and lookups use seed objects.
+func loadOfflineAdmission(obj *unstructured.Unstructured, offline *discovery.Discovery, cache *store.Cache) (*admission.AdmissionCode, error) {
+	spec, err := parseAdmissionSpec(obj)
+	if err != nil {
+		return nil, err
+	}
+	ns := obj.GetNamespace()
+	if obj.GetKind() == NamespaceKind && ns == "" {
+		ns = "default"
+	}
+
+	// resolve kinds, only knowing kinds of objects and requests
+	res := make([]string, 0)
+	known := make(map[string]bool)
+	for _, kind := range spec.Kinds {
+		// kinds of no object or request never receive any request, so they can be ignored
+		resolved, _ := offline.ResolveKinds(kind)
+		for _, k := range resolved {
+			resource := utils.ResourceKey(utils.GVKToString(k.GVK), k.Subresource)
+			if !known[resource] {
+				known[resource] = true
+				res = append(res, resource)
+			}
+		}
+	}
+
+	adm := &admission.Admission{
+		Namespace:  ns,
+		Name:       obj.GetName(),
+		Resources:  res,
+		Javascript: spec.Js,
+		Timeout:    spec.jsTimeout(),
+		Limits:     jsLimits,
+		LeaderOnly: spec.LeaderOnly,
+		Workers:    1,
+
+		LabelSelector: spec.LabelSelector,
+		FieldSelector: spec.FieldSelector,
+		Indexes:       spec.Indexes,
+		Resync:        spec.Resync,
+		Lookup: func(kind string, namespace string, index string, value string) ([]*unstructured.Unstructured, error) {
+			resolved, err := offline.ResolveKinds(kind)
+			if err != nil {
+				return nil, err
+			}
+			for _, k := range resolved {
+				resource := utils.GVKToString(k.GVK)
+				if known[resource] {
+					return cache.ByIndex(resource, namespace, index, value)
+				}
+			}
+			return nil, fmt.Errorf("kind %s is not in admission kinds", kind)
+		},
+	}
+	code, err := admissions.Upsert(adm)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range spec.Indexes {
+		if index.Function != "" && !code.Context.HasFunction(index.Function) {
+			return nil, fmt.Errorf("index function %s not found", index.Function)
+		}
+	}
+	err = code.Init(false)
+	if err != nil {
+		return nil, err
+	}
+	for _, resource := range res {
+		for _, index := range spec.Indexes {
+			cache.AddIndexer(resource, adm.IndexName(index.Name), code.Indexer(index))
+		}
+	}
+	for _, resource := range res {
+		for _, obj := range cache.Find(resource, adm.Namespace) {
+			if !adm.Matches(obj) {
+				continue
+			}
+			if err = code.Created(obj); err != nil {
+				return nil, err
+			}
+		}
+	}
+	admissions.Activate(code)
+	return code, nil
+}
+
+// newTestReview returns the AdmissionReview of a test, read from its file or built from its objects.
+func newTestReview(dir string, test testCase) (*admissionv1.AdmissionReview, error) {
+	object, oldObject := test.Object, test.OldObject
+	if test.File != "" {
+		data, err := os.ReadFile(filepath.Join(dir, test.File))
+		if err != nil {
+			return nil, err
+		}
+		data, err = yaml.ToJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		obj, _, err := deserializer.Decode(data, nil, nil)
+		if err == nil {
+			review, ok := obj.(*admissionv1.AdmissionReview)
+			if !ok || review.Request == nil {
+				return nil, fmt.Errorf("expected v1.AdmissionReview with a request but got: %T", obj)
+			}
+			return review, nil
+		}
+		if err = json.Unmarshal(data, &object); err != nil {
+			return nil, err
+		}
+	}
+	if object == nil {
+		return nil, fmt.Errorf("file or object is required")
+	}
+
+	operation := admissionv1.Operation(test.Operation)
+	if operation == "" {
+		operation = admissionv1.Create
+	}
+	uObj := &unstructured.Unstructured{Object: object}
+	namespace := test.Namespace
+	if namespace == "" {
+		namespace = uObj.GetNamespace()
+	}
+	request := &admissionv1.AdmissionRequest{
+		UID:       types.UID("test"),
+		Kind:      metav1.GroupVersionKind(uObj.GroupVersionKind()),
+		Namespace: namespace,
+		Name:      uObj.GetName(),
+		Operation: operation,
+	}
+	raw, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	if operation == admissionv1.Delete {
+		request.OldObject = runtime.RawExtension{Raw: raw}
+	} else {
+		request.Object = runtime.RawExtension{Raw: raw}
+	}
+	if oldObject != nil {
+		raw, err = json.Marshal(oldObject)
+		if err != nil {
+			return nil, err
+		}
+		request.OldObject = runtime.RawExtension{Raw: raw}
+	}
+	return &admissionv1.AdmissionReview{Request: request}, nil
+}
+
+// runTestCase runs mutate then validate on the mutated object, like the API server.
+func runTestCase(review *admissionv1.AdmissionReview) testResult {
+	response, mutated := mutateObject(review, time.Time{})
+	res := testResult{Allowed: response.Allowed}
+	if response.Result != nil {
+		res.Message = response.Result.Message
+	}
+	if !response.Allowed {
+		return res
+	}
+	if mutated != nil {
+		_ = json.Unmarshal(response.Patch, &res.Patch)
+		res.Object = mutated.Object
+		request := *review.Request
+		raw, _ := json.Marshal(mutated.Object)
+		if request.Operation == admissionv1.Delete {
+			request.OldObject = runtime.RawExtension{Raw: raw}
+		} else {
+			request.Object = runtime.RawExtension{Raw: raw}
+		}
+		review = &admissionv1.AdmissionReview{Request: &request}
+	}
+	response = validate(review, time.Time{})
+	res.Allowed = response.Allowed
+	if response.Result != nil {
+		res.Message = response.Result.Message
+	}
+	return res
+}
+
+// check returns the differences between expected and actual results.
+func (e testExpect) check(res testResult) []string {
+	errs := make([]string, 0)
+	if e.Allowed != nil && *e.Allowed != res.Allowed {
+		errs = append(errs, fmt.Sprintf("expected allowed %v, got %v", *e.Allowed, res.Allowed))
+	}
+	if e.Message != "" && e.Message != res.Message {
+		errs = append(errs, fmt.Sprintf("expected message %q, got %q", e.Message, res.Message))
+	}
+	for _, op := range e.Patch {
+		found := false
+		for _, actual := range res.Patch {
+			if reflect.DeepEqual(normalizeJson(op), actual) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("expected patch operation %s", toJson(op)))
+		}
+	}
+	if e.Object != nil && !containsJson(normalizeJson(e.Object), res.Object) {
+		errs = append(errs, fmt.Sprintf("expected object %s", toJson(e.Object)))
+	}
+	return errs
+}
+
+// containsJson returns true if all fields of expected are in actual, lists being compared item by item.
+func containsJson(expected interface{}, actual interface{}) bool {
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range e {
+			if !containsJson(v, a[k]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok || len(a) != len(e) {
+			return false
+		}
+		for i := range e {
+			if !containsJson(e[i], a[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(normalizeJson(expected), normalizeJson(actual))
+	}
+}
+
+// normalizeJson converts a value to its JSON representation, so numbers are compared as float64.
+func normalizeJson(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var res interface{}
+	if err = json.Unmarshal(data, &res); err != nil {
+		return value
+	}
+	return res
+}
+
+func toJson(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
+
+// readYaml reads a YAML or JSON file.
+func readYaml(file string, into interface{}) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096).Decode(into)
+}
+
+// readObjects reads all objects of a YAML file with several documents, or a JSON file.
+func readObjects(file string) ([]*unstructured.Unstructured, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]*unstructured.Unstructured, 0)
+	decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+	for {
+		obj := map[string]interface{}{}
+		err = decoder.Decode(&obj)
+		if err == io.EOF {
+			return objs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if len(obj) > 0 {
+			objs = append(objs, &unstructured.Unstructured{Object: obj})
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTestSuite(t *testing.T) {
+	// flags are not parsed in tests
+	timeout = DefaultTimeout
+	reports := runTestSuite("tests/suite/suite.yaml")
+	if len(reports) != 4 || reports[0].Name != "pods-count/jsa_test_mutate" {
+		t.Fatalf("failed")
+	}
+	for _, report := range reports {
+		if report.failed() {
+			t.Fatalf("failed %s: %v %s", report.Name, report.Failures, report.Error)
+		}
+	}
+}
+
+func TestTestSuite_Admissions(t *testing.T) {
+	timeout = DefaultTimeout
+	reports := runTestSuite("tests/suite/admissions.yaml")
+	if len(reports) != 1 || reports[0].failed() {
+		t.Fatalf("failed")
+	}
+}
+
+func TestTestReports(t *testing.T) {
+	reports := []testReport{
+		{Suite: "a.yaml", Name: "ok", Duration: time.Second},
+		{Suite: "a.yaml", Name: "failure", Failures: []string{"expected <1>"}},
+		{Suite: "b.yaml", Name: "error", Error: "load"},
+	}
+	var tap bytes.Buffer
+	_ = writeReports(&tap, "tap", false, reports)
+	if !strings.HasPrefix(tap.String(), "TAP version 13\n1..3\nok 1 - a.yaml: ok\nnot ok 2 - a.yaml: failure\n") {
+		t.Fatalf("failed")
+	}
+	var junit bytes.Buffer
+	_ = writeReports(&junit, "junit", false, reports)
+	if !strings.Contains(junit.String(), `<testsuite name="a.yaml" tests="2" failures="1" errors="0" time="1.000">`) ||
+		!strings.Contains(junit.String(), `<failure message="expected &lt;1&gt;">expected &lt;1&gt;</failure>`) ||
+		!strings.Contains(junit.String(), `<testsuite name="b.yaml" tests="1" failures="0" errors="1" time="0.000">`) {
+		t.Fatalf("failed")
+	}
+	var text bytes.Buffer
+	_ = writeReports(&text, "text", true, reports)
+	if strings.Contains(text.String(), "PASS a.yaml") || !strings.Contains(text.String(), "FAIL: 2 failed, 1 passed") {
+		t.Fatalf("failed")
+	}
+}
+
+func TestContainsJson(t *testing.T) {
+	actual := map[string]interface{}{"a": int64(1), "b": []interface{}{"x", map[string]interface{}{"c": true, "d": "y"}}}
+	if !containsJson(map[string]interface{}{"a": 1.0}, actual) {
+		t.Fatalf("failed")
+	}
+	if !containsJson(map[string]interface{}{"b": []interface{}{"x", map[string]interface{}{"c": true}}}, actual) {
+		t.Fatalf("failed")
+	}
+	if containsJson(map[string]interface{}{"b": []interface{}{"x"}}, actual) {
+		t.Fatalf("failed")
+	}
+	if containsJson(map[string]interface{}{"e": "z"}, actual) {
+		t.Fatalf("failed")
+	}
+}
@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"os"
+	"strings"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 )
@@ -17,6 +20,15 @@ func GVK1ToString(gvk metav1.GroupVersionKind) string {
 	return gvk.Group + "/" + gvk.Version + "/" + gvk.Kind
 }
 
+// ResourceKey returns the key of admissions resources, the kind followed by the subresource if any,
+// so admissions of a subresource like pods/status are not called for its parent resource.
+func ResourceKey(gvk string, subresource string) string {
+	if subresource == "" {
+		return gvk
+	}
+	return gvk + "/" + subresource
+}
+
 func GVRToString(gvr schema.GroupVersionResource) string {
 	api := gvr.GroupVersion().String()
 	return api + "/" + gvr.Resource
@@ -28,3 +40,16 @@ func GVR1ToString(gvr metav1.GroupVersionResource) string {
 	}
 	return gvr.Group + "/" + gvr.Version + "/" + gvr.Resource
 }
+
+// CurrentNamespace returns the namespace of the running pod, or defaultNamespace if not running in a pod.
+func CurrentNamespace(defaultNamespace string) string {
+	if ns, ok := os.LookupEnv("POD_NAMESPACE"); ok && ns != "" {
+		return ns
+	}
+	if data, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		if ns := strings.TrimSpace(string(data)); ns != "" {
+			return ns
+		}
+	}
+	return defaultNamespace
+}
@@ -28,4 +28,8 @@ func TestGVKToString(t *testing.T) {
 	if GVR1ToString(metav1.GroupVersionResource{Group: "", Version: "version", Resource: "kind"}) != "version/kind" {
 		t.Fatalf("failed")
 	}
+	//
+	if ResourceKey("v1/Pod", "") != "v1/Pod" || ResourceKey("v1/Pod", "status") != "v1/Pod/status" {
+		t.Fatalf("failed")
+	}
 }
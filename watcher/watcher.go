@@ -3,6 +3,9 @@ package watcher
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,10 +13,17 @@ import (
 	"github.com/momiji/js-admissions-controller/store"
 	"github.com/momiji/js-admissions-controller/utils"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
 	"k8s.io/client-go/tools/cache"
 )
 
@@ -21,43 +31,88 @@ const (
 	CREATED = iota
 	UPDATED
 	DELETED
+	// DELETED_INFERRED is a delete that has not been observed, like when the watch missed it and it is only found on relist
+	DELETED_INFERRED
 )
 
 type Watcher struct {
-	mux       sync.Mutex
-	locks     map[string]*sync.Mutex
-	ctx       context.Context
-	factory   dynamicinformer.DynamicSharedInformerFactory
-	items     *store.Cache
-	handler   cache.ResourceEventHandlerFuncs
-	informers map[schema.GroupVersionResource]cache.SharedIndexInformer
+	mux    sync.Mutex
+	locks  map[string]*sync.Mutex
+	ctx    context.Context
+	client dynamic.Interface
+	meta   metadata.Interface
+	resync time.Duration
+	items  *store.Cache
+	action func(action int, obj *unstructured.Unstructured, old *unstructured.Unstructured)
+	// informers are the informers of each resource by namespace, "" watching all namespaces
+	informers map[schema.GroupVersionResource]map[string]*watcherInformer
+	// refs are the owners referencing each resource, informers are stopped when there is none left
+	refs map[schema.GroupVersionResource]map[string]*Resource
 }
 
-func NewWatcher(ctx context.Context, client dynamic.Interface, action func(action int, obj *unstructured.Unstructured, old *unstructured.Unstructured)) *Watcher {
-	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, time.Minute, corev1.NamespaceAll, nil)
+// Resource is a resource to watch, with options to reduce the memory used by cache.
+type Resource struct {
+	GVR schema.GroupVersionResource
+	// Namespace is the namespace to watch, or "" for all namespaces
+	Namespace string
+	// GVK is the kind of objects, required for MetadataOnly as metadata objects have no kind
+	GVK schema.GroupVersionKind
+	// StripPaths are JSON pointers of fields removed from objects, "*" matching all keys or items
+	StripPaths []string
+	// MetadataOnly only keeps apiVersion, kind and metadata of objects
+	MetadataOnly bool
+	// LabelSelector and FieldSelector only watch matching objects, using the requirements common to all owners
+	LabelSelector string
+	FieldSelector string
+}
+
+type watcherInformer struct {
+	informer     cache.SharedIndexInformer
+	registration cache.ResourceEventHandlerRegistration
+	cancel       context.CancelFunc
+	stopped      bool
+	namespace    string
+	gvk          schema.GroupVersionKind
+	metadataOnly bool
+	strip        [][]string
+	selectors    selectors
+	// gvks are the keys in cache of resources received from this informer
+	gvks map[string]bool
+}
+
+// NewWatcher creates a watcher, meta is optional and only needed to watch resources with MetadataOnly.
+//
+// Informers resync every resync period, or never if 0, and updates of objects with unchanged resourceVersion are ignored.
+func NewWatcher(ctx context.Context, client dynamic.Interface, meta metadata.Interface, resync time.Duration, action func(action int, obj *unstructured.Unstructured, old *unstructured.Unstructured)) *Watcher {
 	items := store.NewCache()
 	watcher := &Watcher{
 		mux:       sync.Mutex{},
 		locks:     make(map[string]*sync.Mutex),
 		ctx:       ctx,
-		factory:   factory,
+		client:    client,
+		meta:      meta,
+		resync:    resync,
 		items:     items,
-		informers: make(map[schema.GroupVersionResource]cache.SharedIndexInformer),
+		action:    action,
+		informers: make(map[schema.GroupVersionResource]map[string]*watcherInformer),
+		refs:      make(map[schema.GroupVersionResource]map[string]*Resource),
 	}
-	watcher.handler = cache.ResourceEventHandlerFuncs{
+	go watcher.reconcileLoop(time.Minute)
+	return watcher
+}
+
+func (w *Watcher) newHandler(wi *watcherInformer) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			item, ok := obj.(*unstructured.Unstructured)
 			if !ok {
 				logs.Errorf("Cache: add item failed, item is not *unstructured.Unstructured")
 				return
 			}
-			gvk := utils.GVKToString(item.GroupVersionKind())
-			watcher.LockResource(gvk)
-			defer watcher.UnlockResource(gvk)
-			logs.Tracef("Cache: add item %s ns=%s name=%s", gvk, item.GetNamespace(), item.GetName())
-			items.Add(gvk, item.GetNamespace(), item.GetName(), item)
-			if action != nil {
-				action(CREATED, item, nil)
+			gvk, ok := w.lockItem(wi, item)
+			defer w.UnlockResource(gvk)
+			if ok {
+				w.add(gvk, item)
 			}
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
@@ -77,76 +132,621 @@ func NewWatcher(ctx context.Context, client dynamic.Interface, action func(actio
 			if oldFound && newFound && oldVers == newVers {
 				return
 			}
-			gvk := utils.GVKToString(newItem.GroupVersionKind())
-			watcher.LockResource(gvk)
-			defer watcher.UnlockResource(gvk)
+			gvk, ok := w.lockItem(wi, newItem)
+			defer w.UnlockResource(gvk)
+			if !ok {
+				return
+			}
 			logs.Tracef("Cache: update item %s ns=%s name=%s", gvk, newItem.GetNamespace(), newItem.GetName())
-			items.Add(gvk, newItem.GetNamespace(), newItem.GetName(), newItem)
-			if action != nil {
-				action(UPDATED, newItem, oldItem)
+			w.items.Add(gvk, newItem.GetNamespace(), newItem.GetName(), newItem)
+			if w.action != nil {
+				w.action(UPDATED, newItem, oldItem)
 			}
 		},
 		DeleteFunc: func(obj interface{}) {
+			// unwrap tombstone, when the delete has been missed by the watch and is only found on relist
+			action := DELETED
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+				action = DELETED_INFERRED
+			}
 			item, ok := obj.(*unstructured.Unstructured)
 			if !ok {
 				logs.Errorf("Cache: delete item failed, item is not *unstructured.Unstructured")
 				return
 			}
-			gvk := utils.GVKToString(item.GroupVersionKind())
-			watcher.LockResource(gvk)
-			defer watcher.UnlockResource(gvk)
-			logs.Tracef("Cache: delete item item %s ns=%s name=%s", gvk, item.GetNamespace(), item.GetName())
-			items.Remove(gvk, item.GetNamespace(), item.GetName())
-			if action != nil {
-				action(DELETED, item, nil)
+			gvk, ok := w.lockItem(wi, item)
+			defer w.UnlockResource(gvk)
+			if ok {
+				w.remove(gvk, item, action)
 			}
 		},
 	}
-	return watcher
+}
 
+// lockItem locks the resource of the item and returns its key, and false if the informer has been stopped.
+func (w *Watcher) lockItem(wi *watcherInformer, item *unstructured.Unstructured) (string, bool) {
+	gvk := w.itemKey(wi, item)
+	w.LockResource(gvk)
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return gvk, !wi.stopped
 }
 
+// itemKey returns the key of the item in cache, remembering it for reconciliation.
+func (w *Watcher) itemKey(wi *watcherInformer, item *unstructured.Unstructured) string {
+	gvk := utils.GVKToString(item.GroupVersionKind())
+	w.mux.Lock()
+	wi.gvks[gvk] = true
+	w.mux.Unlock()
+	return gvk
+}
+
+// add adds the item to cache and calls action, unless this version is already in cache.
+//
+// As items are received again when an informer is restarted, an item already in cache is silently replaced if unchanged,
+// as it may have a different shape, or else it is an update.
+func (w *Watcher) add(gvk string, item *unstructured.Unstructured) {
+	cached := w.items.Get(gvk, item.GetNamespace(), item.GetName())
+	if cached != nil && cached.GetResourceVersion() == item.GetResourceVersion() {
+		w.items.Add(gvk, item.GetNamespace(), item.GetName(), item)
+		return
+	}
+	logs.Tracef("Cache: add item %s ns=%s name=%s", gvk, item.GetNamespace(), item.GetName())
+	w.items.Add(gvk, item.GetNamespace(), item.GetName(), item)
+	if w.action == nil {
+		return
+	}
+	if cached != nil {
+		w.action(UPDATED, item, cached)
+	} else {
+		w.action(CREATED, item, nil)
+	}
+}
+
+// remove removes the item from cache and calls action with the cached item as old, unless it is not in cache anymore.
+func (w *Watcher) remove(gvk string, item *unstructured.Unstructured, action int) {
+	cached := w.items.Get(gvk, item.GetNamespace(), item.GetName())
+	if cached == nil {
+		return
+	}
+	logs.Tracef("Cache: delete item %s ns=%s name=%s inferred=%v", gvk, item.GetNamespace(), item.GetName(), action == DELETED_INFERRED)
+	w.items.Remove(gvk, item.GetNamespace(), item.GetName())
+	if w.action != nil {
+		w.action(action, item, cached)
+	}
+}
+
+func (w *Watcher) reconcileLoop(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+			w.Reconcile()
+		}
+	}
+}
+
+// Reconcile makes the cache consistent with the informers stores, in case some events have been missed.
+//
+// Missing items are added as created, and items not in stores anymore are removed as inferred deletes.
+func (w *Watcher) Reconcile() {
+	w.mux.Lock()
+	informers := make([]*watcherInformer, 0)
+	for _, byNamespace := range w.informers {
+		for _, wi := range byNamespace {
+			informers = append(informers, wi)
+		}
+	}
+	w.mux.Unlock()
+
+	for _, wi := range informers {
+		w.reconcile(wi)
+	}
+}
+
+func (w *Watcher) reconcile(wi *watcherInformer) {
+	if !wi.registration.HasSynced() {
+		return
+	}
+
+	// list items of informer, by gvk
+	listed := make(map[string]map[string]*unstructured.Unstructured)
+	for _, obj := range wi.informer.GetStore().List() {
+		if item, ok := obj.(*unstructured.Unstructured); ok {
+			gvk := w.itemKey(wi, item)
+			if listed[gvk] == nil {
+				listed[gvk] = make(map[string]*unstructured.Unstructured)
+			}
+			listed[gvk][item.GetNamespace()+"/"+item.GetName()] = item
+		}
+	}
+	w.mux.Lock()
+	gvks := make([]string, 0)
+	for gvk := range wi.gvks {
+		gvks = append(gvks, gvk)
+	}
+	w.mux.Unlock()
+
+	// compare with cache, unless informer has been stopped in between
+	for _, gvk := range gvks {
+		w.LockResource(gvk)
+		w.mux.Lock()
+		stopped := wi.stopped
+		w.mux.Unlock()
+		if stopped {
+			w.UnlockResource(gvk)
+			continue
+		}
+		// store has been listed without lock, so candidates are checked again with the current store content
+		for _, item := range w.items.Find(gvk, wi.namespace) {
+			if _, ok := listed[gvk][item.GetNamespace()+"/"+item.GetName()]; !ok {
+				if w.storeItem(wi, item) != nil {
+					continue
+				}
+				logs.Warnf("Cache: reconcile missing delete %s ns=%s name=%s", gvk, item.GetNamespace(), item.GetName())
+				w.remove(gvk, item, DELETED_INFERRED)
+			}
+		}
+		for _, item := range listed[gvk] {
+			if w.items.Get(gvk, item.GetNamespace(), item.GetName()) == nil {
+				item = w.storeItem(wi, item)
+				if item == nil {
+					continue
+				}
+				logs.Warnf("Cache: reconcile missing add %s ns=%s name=%s", gvk, item.GetNamespace(), item.GetName())
+				w.add(gvk, item)
+			}
+		}
+		w.UnlockResource(gvk)
+	}
+}
+
+// storeItem returns the current item from informer store, or nil if it is not in store anymore.
+func (w *Watcher) storeItem(wi *watcherInformer, item *unstructured.Unstructured) *unstructured.Unstructured {
+	key, err := cache.MetaNamespaceKeyFunc(item)
+	if err != nil {
+		return nil
+	}
+	obj, exists, err := wi.informer.GetStore().GetByKey(key)
+	if err != nil || !exists {
+		return nil
+	}
+	current, _ := obj.(*unstructured.Unstructured)
+	return current
+}
+
+// Add starts watching resources, and waits until all existing resources are loaded in cache.
+//
+// Resources added this way are never stopped, use Watch for resources that can be released.
 func (w *Watcher) Add(gvr schema.GroupVersionResource) error {
+	return w.acquire("", Resource{GVR: gvr})
+}
+
+// Watch sets the resources referenced by owner, like an admission, and waits until they are all loaded in cache.
+//
+// Resources not referenced anymore by any owner are stopped, and removed from cache.
+func (w *Watcher) Watch(owner string, resources []Resource) error {
+	// acquire new resources first, so resources still referenced are not stopped
+	keep := make(map[schema.GroupVersionResource]bool)
+	for _, resource := range resources {
+		keep[resource.GVR] = true
+		err := w.acquire(owner, resource)
+		if err != nil {
+			return err
+		}
+	}
+
+	// release resources not referenced anymore
+	for _, gvr := range w.referenced(owner) {
+		if !keep[gvr] {
+			w.release(owner, gvr)
+		}
+	}
+	return nil
+}
+
+// Release releases all resources referenced by owner.
+func (w *Watcher) Release(owner string) {
+	for _, gvr := range w.referenced(owner) {
+		w.release(owner, gvr)
+	}
+}
+
+func (w *Watcher) referenced(owner string) []schema.GroupVersionResource {
 	w.mux.Lock()
 	defer w.mux.Unlock()
+	gvrs := make([]schema.GroupVersionResource, 0)
+	for gvr, owners := range w.refs {
+		if _, ok := owners[owner]; ok {
+			gvrs = append(gvrs, gvr)
+		}
+	}
+	return gvrs
+}
 
-	// create new informer
-	informer, ok := w.informers[gvr]
-	if ok {
-		return nil
+func (w *Watcher) acquire(owner string, resource Resource) error {
+	gvr := resource.GVR
+	w.mux.Lock()
+
+	// add reference
+	if _, ok := w.refs[gvr]; !ok {
+		w.refs[gvr] = make(map[string]*Resource)
 	}
+	w.refs[gvr][owner] = &resource
 
-	informer = w.factory.ForResource(gvr).Informer()
-	_, err := informer.AddEventHandler(w.handler)
+	// create new informers, or update existing ones with new options
+	informers, gvks, err := w.update(gvr)
+	w.mux.Unlock()
 	if err != nil {
-		return fmt.Errorf("failed loading resources %s: %v", utils.GVRToString(gvr), err)
+		return err
 	}
-	w.informers[gvr] = informer
-
-	// start loading resources
-	logs.Infof("Start loading resources %s", utils.GVRToString(gvr))
-	go informer.Run(w.ctx.Done())
+	w.purge(gvr, gvks)
 
-	// wait for resources to be synced
-	isSynced := cache.WaitForCacheSync(w.ctx.Done(), informer.HasSynced)
-	if !isSynced {
-		return fmt.Errorf("failed loading resources %s", utils.GVRToString(gvr))
+	// wait for resources to be synced, outside of lock to not block other resources,
+	// and until handler has received all existing resources, so they are all in cache
+	for _, wi := range informers {
+		isSynced := cache.WaitForCacheSync(w.ctx.Done(), wi.informer.HasSynced, wi.registration.HasSynced)
+		if !isSynced {
+			return fmt.Errorf("failed loading resources %s", utils.GVRToString(gvr))
+		}
 	}
 	return nil
 }
 
+func (w *Watcher) release(owner string, gvr schema.GroupVersionResource) {
+	w.mux.Lock()
+
+	// remove reference, updating informers with options of remaining owners
+	delete(w.refs[gvr], owner)
+	if len(w.refs[gvr]) == 0 {
+		delete(w.refs, gvr)
+	}
+	_, gvks, err := w.update(gvr)
+	w.mux.Unlock()
+	if err != nil {
+		logs.Errorf("Cache: failed to update resources %s: %v", utils.GVRToString(gvr), err)
+	}
+	w.purge(gvr, gvks)
+}
+
+// update starts the informers of the resource, using the options of all owners, must be called with lock held.
+//
+// Resources are watched in all namespaces if at least one owner needs it, else only in namespaces of owners.
+// Strip paths of a running informer only apply to objects received after the update,
+// while switching from or to metadata only, changing selectors or namespaces, restarts informers, replacing objects in cache when received again.
+//
+// It returns the running informers, and the keys in cache of stopped informers, that must be purged without lock.
+func (w *Watcher) update(gvr schema.GroupVersionResource) ([]*watcherInformer, []string, error) {
+	gvk, metadataOnly, strip, selectors, namespaces := w.options(gvr)
+
+	// keep informers with the same options, and start new ones
+	current := w.informers[gvr]
+	next := make(map[string]*watcherInformer)
+	started := make([]*watcherInformer, 0)
+	for namespace := range namespaces {
+		if wi, ok := current[namespace]; ok && wi.metadataOnly == metadataOnly && wi.selectors == selectors {
+			wi.strip = strip
+			next[namespace] = wi
+			continue
+		}
+		wi, err := w.start(gvr, namespace, gvk, metadataOnly, strip, selectors)
+		if err != nil {
+			for _, wi := range started {
+				wi.cancel()
+			}
+			return nil, nil, err
+		}
+		next[namespace] = wi
+		started = append(started, wi)
+	}
+
+	// stop other informers, preventing handlers to update cache
+	gvks := make(map[string]bool)
+	for namespace, wi := range current {
+		if next[namespace] == wi {
+			continue
+		}
+		logs.Infof("Stop loading resources %s ns=%s", utils.GVRToString(gvr), namespace)
+		wi.stopped = true
+		wi.cancel()
+		for gvk := range wi.gvks {
+			gvks[gvk] = true
+		}
+	}
+	if len(next) == 0 {
+		delete(w.informers, gvr)
+	} else {
+		w.informers[gvr] = next
+	}
+
+	// objects of stopped informers are kept in cache until they are received again,
+	// then reconcile removes objects deleted in between
+	if len(gvks) > 0 {
+		for _, wi := range started {
+			wi := wi
+			for gvk := range gvks {
+				wi.gvks[gvk] = true
+			}
+			go func() {
+				if cache.WaitForCacheSync(w.ctx.Done(), wi.registration.HasSynced) {
+					w.reconcile(wi)
+				}
+			}()
+		}
+	}
+
+	informers := make([]*watcherInformer, 0)
+	for _, wi := range next {
+		informers = append(informers, wi)
+	}
+	keys := make([]string, 0)
+	for gvk := range gvks {
+		keys = append(keys, gvk)
+	}
+	return informers, keys, nil
+}
+
+// start starts a new informer, with its own stop channel, must be called with lock held.
+func (w *Watcher) start(gvr schema.GroupVersionResource, namespace string, gvk schema.GroupVersionKind, metadataOnly bool, strip [][]string, selectors selectors) (*watcherInformer, error) {
+	wi := &watcherInformer{namespace: namespace, gvk: gvk, metadataOnly: metadataOnly, strip: strip, selectors: selectors, gvks: make(map[string]bool)}
+	tweak := func(options *metav1.ListOptions) {
+		options.LabelSelector = selectors.labels
+		options.FieldSelector = selectors.fields
+	}
+	var informer cache.SharedIndexInformer
+	if metadataOnly {
+		informer = metadatainformer.NewFilteredMetadataInformer(w.meta, gvr, namespace, w.resync, cache.Indexers{}, tweak).Informer()
+	} else {
+		informer = dynamicinformer.NewFilteredDynamicInformer(w.client, gvr, namespace, w.resync, cache.Indexers{}, tweak).Informer()
+	}
+	err := informer.SetTransform(w.transform(wi))
+	if err != nil {
+		return nil, fmt.Errorf("failed loading resources %s: %v", utils.GVRToString(gvr), err)
+	}
+	registration, err := informer.AddEventHandler(w.newHandler(wi))
+	if err != nil {
+		return nil, fmt.Errorf("failed loading resources %s: %v", utils.GVRToString(gvr), err)
+	}
+	wi.informer = informer
+	wi.registration = registration
+	logs.Infof("Start loading resources %s ns=%s metadataOnly=%v labels=%q fields=%q", utils.GVRToString(gvr), namespace, metadataOnly, selectors.labels, selectors.fields)
+	ctx, cancel := context.WithCancel(w.ctx)
+	wi.cancel = cancel
+	go informer.Run(ctx.Done())
+	return wi, nil
+}
+
+// purge removes from cache the objects in namespaces not watched anymore by the resource informers.
+func (w *Watcher) purge(gvr schema.GroupVersionResource, gvks []string) {
+	for _, gvk := range gvks {
+		w.LockResource(gvk)
+
+		// get watched namespaces, as informers may have been updated in between
+		w.mux.Lock()
+		namespaces := make(map[string]bool)
+		for namespace := range w.informers[gvr] {
+			namespaces[namespace] = true
+		}
+		w.mux.Unlock()
+
+		switch {
+		case len(namespaces) == 0:
+			w.items.Purge(gvk)
+		case !namespaces[corev1.NamespaceAll]:
+			for _, item := range w.items.Find(gvk, "") {
+				if !namespaces[item.GetNamespace()] {
+					w.items.Remove(gvk, item.GetNamespace(), item.GetName())
+				}
+			}
+		}
+		w.UnlockResource(gvk)
+	}
+}
+
+// options returns the options of a resource shared by all owners, must be called with lock held.
+//
+// Objects are metadata only if all owners only need metadata, and paths are stripped only if all owners strip them.
+// Selectors only keep the requirements of all owners, so they match all objects matched by at least one owner.
+func (w *Watcher) options(gvr schema.GroupVersionResource) (schema.GroupVersionKind, bool, [][]string, selectors, map[string]bool) {
+	gvk := schema.GroupVersionKind{}
+	metadataOnly := w.meta != nil
+	namespaces := make(map[string]bool)
+	counts := make(map[string]int)
+	for _, resource := range w.refs[gvr] {
+		if !resource.GVK.Empty() {
+			gvk = resource.GVK
+		}
+		metadataOnly = metadataOnly && resource.MetadataOnly
+		namespaces[resource.Namespace] = true
+		paths := make(map[string]bool)
+		for _, path := range resource.StripPaths {
+			if !paths[path] {
+				paths[path] = true
+				counts[path]++
+			}
+		}
+	}
+	if namespaces[corev1.NamespaceAll] {
+		namespaces = map[string]bool{corev1.NamespaceAll: true}
+	}
+	strip := make([][]string, 0)
+	for path, count := range counts {
+		if count == len(w.refs[gvr]) {
+			strip = append(strip, store.ParsePointer(path))
+		}
+	}
+	return gvk, metadataOnly && !gvk.Empty(), strip, w.selectors(gvr), namespaces
+}
+
+// selectors are the label and field selectors of an informer.
+type selectors struct {
+	labels string
+	fields string
+}
+
+// selectors returns the label and field selectors with requirements common to all owners, must be called with lock held.
+//
+// Invalid selectors are ignored, matching all objects.
+func (w *Watcher) selectors(gvr schema.GroupVersionResource) selectors {
+	labelCounts := make(map[string]int)
+	labelRequirements := make(map[string]labels.Requirement)
+	fieldCounts := make(map[string]int)
+	fieldRequirements := make(map[string]fields.Requirement)
+	for _, resource := range w.refs[gvr] {
+		if selector, err := labels.Parse(resource.LabelSelector); err == nil {
+			requirements, _ := selector.Requirements()
+			for _, requirement := range requirements {
+				labelCounts[requirement.String()]++
+				labelRequirements[requirement.String()] = requirement
+			}
+		}
+		if selector, err := fields.ParseSelector(resource.FieldSelector); err == nil {
+			for _, requirement := range selector.Requirements() {
+				key := requirement.Field + "=" + requirement.Value
+				if requirement.Operator == selection.NotEquals {
+					key = requirement.Field + "!=" + requirement.Value
+				}
+				fieldCounts[key]++
+				fieldRequirements[key] = requirement
+			}
+		}
+	}
+
+	// build selectors, sorted so they are the same when requirements are the same
+	labelKeys := make([]string, 0)
+	for key, count := range labelCounts {
+		if count == len(w.refs[gvr]) {
+			labelKeys = append(labelKeys, key)
+		}
+	}
+	sort.Strings(labelKeys)
+	labelSelector := labels.NewSelector()
+	for _, key := range labelKeys {
+		labelSelector = labelSelector.Add(labelRequirements[key])
+	}
+	fieldSelectors := make([]string, 0)
+	for key, count := range fieldCounts {
+		if count == len(w.refs[gvr]) {
+			requirement := fieldRequirements[key]
+			if requirement.Operator == selection.NotEquals {
+				fieldSelectors = append(fieldSelectors, fields.OneTermNotEqualSelector(requirement.Field, requirement.Value).String())
+			} else {
+				fieldSelectors = append(fieldSelectors, fields.OneTermEqualSelector(requirement.Field, requirement.Value).String())
+			}
+		}
+	}
+	sort.Strings(fieldSelectors)
+	return selectors{labels: labelSelector.String(), fields: strings.Join(fieldSelectors, ",")}
+}
+
+// transform reduces the memory used by objects before they are stored in informer and cache.
+//
+// Metadata objects are converted to unstructured objects, managedFields and strip paths are removed.
+func (w *Watcher) transform(wi *watcherInformer) cache.TransformFunc {
+	return func(obj interface{}) (interface{}, error) {
+		if meta, ok := obj.(*metav1.PartialObjectMetadata); ok {
+			content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&meta.ObjectMeta)
+			if err != nil {
+				return nil, err
+			}
+			item := &unstructured.Unstructured{Object: map[string]interface{}{"metadata": content}}
+			item.SetGroupVersionKind(wi.gvk)
+			obj = item
+		}
+		item, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return obj, nil
+		}
+		w.mux.Lock()
+		strip := wi.strip
+		w.mux.Unlock()
+		unstructured.RemoveNestedField(item.Object, "metadata", "managedFields")
+		for _, path := range strip {
+			removePath(item.Object, path)
+		}
+		return item, nil
+	}
+}
+
+// removePath removes the field at path, "*" matching all keys of a map or all items of a list.
+func removePath(obj interface{}, path []string) {
+	if len(path) == 0 {
+		return
+	}
+	switch o := obj.(type) {
+	case map[string]interface{}:
+		for key, value := range o {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			if len(path) == 1 {
+				delete(o, key)
+			} else {
+				removePath(value, path[1:])
+			}
+		}
+	case []interface{}:
+		// list items are never removed, only their fields
+		if len(path) == 1 {
+			return
+		}
+		for i, value := range o {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				removePath(value, path[1:])
+			}
+		}
+	}
+}
+
+// LockResource prevents events of this resource to be handled, until UnlockResource is called.
+//
+// Events are handled while holding the lock, so updating the cache and calling the handler is atomic.
 func (w *Watcher) LockResource(resource string) {
 	w.mux.Lock()
-	//defer w.mux.Unlock()
-	//if _, ok := w.locks[resource]; !ok {
-	//	w.locks[resource] = &sync.Mutex{}
-	//}
-	//w.locks[resource].Lock()
+	lock, ok := w.locks[resource]
+	if !ok {
+		lock = &sync.Mutex{}
+		w.locks[resource] = lock
+	}
+	w.mux.Unlock()
+	lock.Lock()
 }
+
 func (w *Watcher) UnlockResource(resource string) {
-	//w.mux.Lock()
-	defer w.mux.Unlock()
-	//w.locks[resource].Unlock()
+	w.mux.Lock()
+	lock := w.locks[resource]
+	w.mux.Unlock()
+	lock.Unlock()
+}
+
+// LockResources locks several resources, always in the same order to prevent deadlocks.
+func (w *Watcher) LockResources(resources []string) {
+	for _, resource := range sortedResources(resources) {
+		w.LockResource(resource)
+	}
+}
+
+func (w *Watcher) UnlockResources(resources []string) {
+	for _, resource := range sortedResources(resources) {
+		w.UnlockResource(resource)
+	}
+}
+
+func sortedResources(resources []string) []string {
+	keys := make(map[string]bool)
+	sorted := make([]string, 0)
+	for _, resource := range resources {
+		if !keys[resource] {
+			keys[resource] = true
+			sorted = append(sorted, resource)
+		}
+	}
+	sort.Strings(sorted)
+	return sorted
 }
 
 // GetResources return all resources with the same namespace or for all namespaces if namespace=""
@@ -156,3 +756,24 @@ func (w *Watcher) UnlockResource(resource string) {
 func (w *Watcher) GetResources(resource string, namespace string) []*unstructured.Unstructured {
 	return w.items.Find(resource, namespace)
 }
+
+// GetResource returns a resource, or nil if it is not in cache.
+func (w *Watcher) GetResource(resource string, namespace string, name string) *unstructured.Unstructured {
+	return w.items.Get(resource, namespace, name)
+}
+
+// AddIndexer adds an index on a resource, which must be locked while indexing objects already in cache.
+func (w *Watcher) AddIndexer(resource string, name string, indexer store.IndexFunc) {
+	w.items.AddIndexer(resource, name, indexer)
+}
+
+func (w *Watcher) RemoveIndexer(resource string, name string) {
+	w.items.RemoveIndexer(resource, name)
+}
+
+// LookupResources returns copies of resources with the same namespace or for all namespaces if namespace="", having this value in the index.
+//
+// If index is empty, all resources are returned.
+func (w *Watcher) LookupResources(resource string, namespace string, index string, value string) ([]*unstructured.Unstructured, error) {
+	return w.items.ByIndex(resource, namespace, index, value)
+}
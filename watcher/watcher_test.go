@@ -0,0 +1,408 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	podsGVR = schema.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
+	podsGVK = "v1/Pod"
+)
+
+func newPod(name string, value int) *unstructured.Unstructured {
+	pod := &unstructured.Unstructured{}
+	pod.SetAPIVersion("v1")
+	pod.SetKind("Pod")
+	pod.SetNamespace("ns")
+	pod.SetName(name)
+	pod.SetResourceVersion(fmt.Sprint(value))
+	return pod
+}
+
+func TestWatcher_Locks(t *testing.T) {
+	w := NewWatcher(context.Background(), fake.NewSimpleDynamicClient(runtime.NewScheme()), nil, time.Minute, nil)
+
+	// check locking a resource does not block other resources
+	w.LockResources([]string{"a", "c", "a"})
+	done := make(chan struct{})
+	go func() {
+		w.LockResource("b")
+		w.UnlockResource("b")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("failed")
+	}
+
+	// check a locked resource is blocked
+	done = make(chan struct{})
+	go func() {
+		w.LockResource("a")
+		w.UnlockResource("a")
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("failed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	w.UnlockResources([]string{"a", "c", "a"})
+	<-done
+}
+
+func TestWatcher_NoLostEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{podsGVR: "PodList"})
+
+	// a fake admission, counting objects from events, replaced while objects are modified
+	type code struct {
+		names map[string]bool
+	}
+	current := &code{names: make(map[string]bool)}
+	w := NewWatcher(ctx, client, nil, time.Minute, func(action int, obj *unstructured.Unstructured, old *unstructured.Unstructured) {
+		switch action {
+		case CREATED, UPDATED:
+			current.names[obj.GetName()] = true
+		case DELETED:
+			delete(current.names, obj.GetName())
+		}
+	})
+	if err := w.Add(podsGVR); err != nil {
+		t.Fatalf("failed")
+	}
+
+	// hammer add/update/delete
+	pods := client.Resource(podsGVR).Namespace("ns")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 300; i++ {
+			_, _ = pods.Create(ctx, newPod(fmt.Sprintf("pod-%d", i), i), metav1.CreateOptions{})
+			if i%3 == 0 {
+				_, _ = pods.Update(ctx, newPod(fmt.Sprintf("pod-%d", i), i+1000), metav1.UpdateOptions{})
+			}
+			if i%2 == 1 {
+				_ = pods.Delete(ctx, fmt.Sprintf("pod-%d", i-1), metav1.DeleteOptions{})
+			}
+			// let the informer consume the fake watch channel, which is limited to 100 events
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// re-upsert admission, replaying objects from cache like admissionHandler
+	upserts := 0
+	for running := true; running; upserts++ {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		w.LockResources([]string{podsGVK})
+		replayed := &code{names: make(map[string]bool)}
+		for _, obj := range w.GetResources(podsGVK, "") {
+			replayed.names[obj.GetName()] = true
+		}
+		current = replayed
+		w.UnlockResources([]string{podsGVK})
+		time.Sleep(100 * time.Microsecond)
+	}
+
+	// wait for all events to be received, 150 pods remaining
+	for i := 0; i < 100 && len(w.GetResources(podsGVK, "")) != 150; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// check admission knows exactly all objects in cache
+	w.LockResources([]string{podsGVK})
+	defer w.UnlockResources([]string{podsGVK})
+	objs := w.GetResources(podsGVK, "")
+	if len(objs) != 150 || len(current.names) != 150 {
+		t.Fatalf("failed: %d objects, %d known, %d upserts", len(objs), len(current.names), upserts)
+	}
+	for _, obj := range objs {
+		if !current.names[obj.GetName()] {
+			t.Fatalf("failed")
+		}
+	}
+}
+
+func TestWatcher_Tombstones(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{podsGVR: "PodList"}, newPod("pod-1", 1), newPod("pod-2", 2))
+
+	actions := make(map[string]int)
+	w := NewWatcher(ctx, client, nil, time.Minute, func(action int, obj *unstructured.Unstructured, old *unstructured.Unstructured) {
+		actions[obj.GetName()] = action
+	})
+	if err := w.Add(podsGVR); err != nil || len(w.GetResources(podsGVK, "")) != 2 {
+		t.Fatalf("failed")
+	}
+
+	// check tombstone is unwrapped and delete is inferred
+	handler := w.newHandler(w.informers[podsGVR][""])
+	handler.OnDelete(cache.DeletedFinalStateUnknown{Key: "ns/pod-1", Obj: newPod("pod-1", 1)})
+	if len(w.GetResources(podsGVK, "")) != 1 || actions["pod-1"] != DELETED_INFERRED {
+		t.Fatalf("failed")
+	}
+
+	// check a second delete of the same object is ignored
+	actions["pod-1"] = -1
+	handler.OnDelete(newPod("pod-1", 1))
+	if actions["pod-1"] != -1 {
+		t.Fatalf("failed")
+	}
+
+	// check reconcile removes items not in informer, and adds missing ones
+	w.items.Add(podsGVK, "ns", "ghost", newPod("ghost", 3))
+	w.Reconcile()
+	objs := w.GetResources(podsGVK, "")
+	if len(objs) != 2 || actions["ghost"] != DELETED_INFERRED || actions["pod-1"] != CREATED {
+		t.Fatalf("failed")
+	}
+
+	// check items added or removed between store list and resource lock are left untouched
+	store := w.informers[podsGVR][""].informer.GetStore()
+	w.LockResource(podsGVK)
+	done := make(chan struct{})
+	go func() {
+		w.Reconcile()
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	late := newPod("late", 4)
+	_ = store.Add(late)
+	w.items.Add(podsGVK, "ns", "late", late)
+	_ = store.Delete(newPod("pod-2", 2))
+	w.items.Remove(podsGVK, "ns", "pod-2")
+	actions = make(map[string]int)
+	w.UnlockResource(podsGVK)
+	<-done
+	if len(w.GetResources(podsGVK, "")) != 2 || len(actions) != 0 {
+		t.Fatalf("failed %v", actions)
+	}
+}
+
+func TestWatcher_References(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{podsGVR: "PodList"}, newPod("pod-1", 1))
+	w := NewWatcher(ctx, client, nil, time.Minute, nil)
+
+	// two owners referencing the same resource
+	if err := w.Watch("a", []Resource{{GVR: podsGVR}}); err != nil {
+		t.Fatalf("failed")
+	}
+	if err := w.Watch("b", []Resource{{GVR: podsGVR}}); err != nil {
+		t.Fatalf("failed")
+	}
+	if len(w.informers) != 1 || len(w.GetResources(podsGVK, "")) != 1 {
+		t.Fatalf("failed")
+	}
+
+	// check resource is still watched while referenced
+	w.Release("a")
+	if len(w.informers) != 1 || len(w.GetResources(podsGVK, "")) != 1 {
+		t.Fatalf("failed")
+	}
+
+	// check resource is stopped and purged when not referenced anymore
+	if err := w.Watch("b", nil); err != nil {
+		t.Fatalf("failed")
+	}
+	if len(w.informers) != 0 || len(w.refs) != 0 || len(w.GetResources(podsGVK, "")) != 0 {
+		t.Fatalf("failed")
+	}
+
+	// check resource can be watched again
+	if err := w.Watch("a", []Resource{{GVR: podsGVR}}); err != nil || len(w.GetResources(podsGVK, "")) != 1 {
+		t.Fatalf("failed")
+	}
+}
+
+func TestWatcher_Transform(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pod := newPod("pod-1", 1)
+	pod.SetAnnotations(map[string]string{"a/b": "x", "c": "y"})
+	pod.SetManagedFields([]metav1.ManagedFieldsEntry{{Manager: "kubectl"}})
+	_ = unstructured.SetNestedSlice(pod.Object, []interface{}{map[string]interface{}{"name": "main", "env": []interface{}{}}}, "spec", "containers")
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{podsGVR: "PodList"}, pod)
+	meta := &metav1.PartialObjectMetadata{TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"}, ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod-1", ResourceVersion: "1"}}
+	scheme := metadatafake.NewTestScheme()
+	_ = metav1.AddMetaToScheme(scheme)
+	metaClient := metadatafake.NewSimpleMetadataClient(scheme, meta)
+
+	actions := 0
+	w := NewWatcher(ctx, client, metaClient, time.Minute, func(action int, obj *unstructured.Unstructured, old *unstructured.Unstructured) {
+		actions++
+	})
+	gvk := schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	cached := func() *unstructured.Unstructured {
+		w.LockResource(podsGVK)
+		defer w.UnlockResource(podsGVK)
+		return w.items.Get(podsGVK, "ns", "pod-1")
+	}
+
+	// check managedFields and strip paths are removed
+	if err := w.Watch("a", []Resource{{GVR: podsGVR, GVK: gvk, StripPaths: []string{"/metadata/annotations/a~1b", "/spec/containers/*/env"}}}); err != nil {
+		t.Fatalf("failed")
+	}
+	obj := cached()
+	if obj.GetManagedFields() != nil || len(obj.GetAnnotations()) != 1 {
+		t.Fatalf("failed")
+	}
+	containers, _, _ := unstructured.NestedSlice(obj.Object, "spec", "containers")
+	if len(containers) != 1 || len(containers[0].(map[string]interface{})) != 1 {
+		t.Fatalf("failed")
+	}
+
+	// check informer is not metadata only while an owner needs full objects
+	if err := w.Watch("b", []Resource{{GVR: podsGVR, GVK: gvk, MetadataOnly: true}}); err != nil || w.informers[podsGVR][""].metadataOnly {
+		t.Fatalf("failed")
+	}
+
+	// check informer is restarted as metadata only, replacing objects without events
+	w.Release("a")
+	if !w.informers[podsGVR][""].metadataOnly {
+		t.Fatalf("failed")
+	}
+	for i := 0; i < 100 && cached().Object["spec"] != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	obj = cached()
+	if obj.Object["spec"] != nil || obj.GetKind() != "Pod" || obj.GetName() != "pod-1" || actions != 1 {
+		t.Fatalf("failed")
+	}
+
+	// check informer is restarted with full objects
+	if err := w.Watch("a", []Resource{{GVR: podsGVR, GVK: gvk}}); err != nil || w.informers[podsGVR][""].metadataOnly {
+		t.Fatalf("failed")
+	}
+	for i := 0; i < 100 && cached().Object["spec"] == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cached().Object["spec"] == nil || actions != 1 {
+		t.Fatalf("failed")
+	}
+}
+
+func TestWatcher_Namespaces(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pods := make([]runtime.Object, 0)
+	for i, ns := range []string{"ns1", "ns2", "ns3"} {
+		pod := newPod("pod-"+ns, i)
+		pod.SetNamespace(ns)
+		pods = append(pods, pod)
+	}
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{podsGVR: "PodList"}, pods...)
+
+	actions := 0
+	w := NewWatcher(ctx, client, nil, time.Minute, func(action int, obj *unstructured.Unstructured, old *unstructured.Unstructured) {
+		actions++
+	})
+	count := func() int {
+		w.LockResource(podsGVK)
+		defer w.UnlockResource(podsGVK)
+		return len(w.GetResources(podsGVK, ""))
+	}
+
+	// check only namespaces of owners are watched
+	if err := w.Watch("a", []Resource{{GVR: podsGVR, Namespace: "ns1"}}); err != nil {
+		t.Fatalf("failed")
+	}
+	if err := w.Watch("b", []Resource{{GVR: podsGVR, Namespace: "ns2"}}); err != nil {
+		t.Fatalf("failed")
+	}
+	if len(w.informers[podsGVR]) != 2 || count() != 2 || actions != 2 {
+		t.Fatalf("failed")
+	}
+
+	// check namespace informers are merged into a cluster-wide informer
+	if err := w.Watch("c", []Resource{{GVR: podsGVR}}); err != nil {
+		t.Fatalf("failed")
+	}
+	if len(w.informers[podsGVR]) != 1 || w.informers[podsGVR][""] == nil || count() != 3 || actions != 3 {
+		t.Fatalf("failed")
+	}
+
+	// check cluster-wide informer is split again, removing objects of other namespaces
+	w.Release("c")
+	if len(w.informers[podsGVR]) != 2 || count() != 2 {
+		t.Fatalf("failed")
+	}
+	w.Release("a")
+	if len(w.informers[podsGVR]) != 1 || w.informers[podsGVR]["ns2"] == nil || count() != 1 {
+		t.Fatalf("failed")
+	}
+
+	// check reconcile does not remove objects kept from stopped informers
+	time.Sleep(100 * time.Millisecond)
+	w.Reconcile()
+	if count() != 1 || actions != 3 {
+		t.Fatalf("failed")
+	}
+}
+
+func TestWatcher_Selectors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pods := make([]runtime.Object, 0)
+	for i, podLabels := range []map[string]string{{"app": "a", "tier": "web"}, {"app": "a"}, {"app": "b"}} {
+		pod := newPod(fmt.Sprintf("pod-%d", i), i)
+		pod.SetLabels(podLabels)
+		pods = append(pods, pod)
+	}
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{podsGVR: "PodList"}, pods...)
+
+	w := NewWatcher(ctx, client, nil, time.Minute, nil)
+	count := func() int {
+		w.LockResource(podsGVK)
+		defer w.UnlockResource(podsGVK)
+		return len(w.GetResources(podsGVK, ""))
+	}
+
+	// check only requirements common to all owners are used
+	if err := w.Watch("a", []Resource{{GVR: podsGVR, LabelSelector: "tier=web,app=a", FieldSelector: "metadata.name!=x"}}); err != nil {
+		t.Fatalf("failed")
+	}
+	if err := w.Watch("b", []Resource{{GVR: podsGVR, LabelSelector: "app=a", FieldSelector: "metadata.name!=x,status.phase=Running"}}); err != nil {
+		t.Fatalf("failed")
+	}
+	wi := w.informers[podsGVR][""]
+	if wi.selectors.labels != "app=a" || wi.selectors.fields != "metadata.name!=x" || count() != 2 {
+		t.Fatalf("failed")
+	}
+
+	// check informer is not restarted when selectors are unchanged
+	if err := w.Watch("b", []Resource{{GVR: podsGVR, LabelSelector: "app=a", FieldSelector: "metadata.name!=x"}}); err != nil || w.informers[podsGVR][""] != wi {
+		t.Fatalf("failed")
+	}
+
+	// check informer is restarted with new selectors, removing objects not matching anymore
+	w.Release("b")
+	if w.informers[podsGVR][""].selectors.labels != "app=a,tier=web" {
+		t.Fatalf("failed")
+	}
+	for i := 0; i < 100 && count() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count() != 1 {
+		t.Fatalf("failed")
+	}
+}